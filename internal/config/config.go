@@ -1,8 +1,12 @@
 package config
 
 import (
+	"crypto/rand"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -11,31 +15,173 @@ import (
 )
 
 type Config struct {
-	Port         string
-	StoragePath  string
-	APIKey       string
-	RequireAPIKey bool
-	S3           bool
-	S3Endpoint   string
-	S3AccessKey  string
-	S3SecretKey  string
-	S3Region     string
-	S3Bucket     string
-	S3Client     *s3.S3
+	Port                  string
+	StoragePath           string
+	UsagePath             string
+	UsageSaveInterval     time.Duration
+	UsagePrefixSeparators string
+	APIKey                string
+	RequireAPIKey         bool
+	APIKeysFile           string
+	PublicRead            bool
+	PublicURL             string
+	TrustedProxies        []string
+	SigningKey            []byte
+	SignedURLMaxTTL       time.Duration
+	APIKeys               []APIKey
+	S3                    bool
+	S3Endpoint            string
+	S3AccessKey           string
+	S3SecretKey           string
+	S3Region              string
+	S3Bucket              string
+	S3PartSize            int64
+	S3UploadConcurrency   int
+	TusUploadExpiry       time.Duration
+	S3Redirect            bool
+	S3RedirectTTL         time.Duration
+	S3Client              *s3.S3
+	FetchSchemes          []string
+	FetchAllowHosts       []string
+	FetchDenyHosts        []string
+	FetchAllowPrivate     bool
+	FetchMaxRedirects     int
+	FetchMaxBytes         int64
+	FetchConnectTimeout   time.Duration
+	FetchTimeout          time.Duration
+	FetchAllowedTypes     []string
+	FetchRetries          int
+	FetchRetryBaseDelay   time.Duration
+	FetchRetryMaxDelay    time.Duration
+	BatchMaxItems         int
+	BatchConcurrency      int
+	BatchHostConcurrency  int
+	JobWorkers            int
+	JobQueueSize          int
+	JobRetention          time.Duration
+	WebhookSecret         []byte
+	WebhookMaxAttempts    int
+	WebhookTimeout        time.Duration
+	QuotaBytes            int64
+	QuotaSoftPercent      int
+	KeyQuotas             map[string]int64
 }
 
 func Load() *Config {
 	cfg := &Config{
-		Port:         getEnv("PORT", "3000"),
-		StoragePath:  getEnv("STORAGE_PATH", "./storage"),
-		APIKey:       getEnv("API_KEY", "super-secret-key"),
-		RequireAPIKey: getEnvBool("REQUIRE_API_KEY", true),
-		S3:           getEnvBool("S3", false),
-		S3Endpoint:   getEnv("S3_ENDPOINT", ""),
-		S3AccessKey:  getEnv("S3_ACCESS_KEY", ""),
-		S3SecretKey:  getEnv("S3_SECRET_KEY", ""),
-		S3Region:     getEnv("S3_REGION", "us-east-1"),
-		S3Bucket:     getEnv("S3_BUCKET", "viespirkiai"),
+		Port:                  getEnv("PORT", "3000"),
+		StoragePath:           getEnv("STORAGE_PATH", "./storage"),
+		UsageSaveInterval:     getEnvDuration("USAGE_SAVE_INTERVAL", time.Second),
+		UsagePrefixSeparators: getEnv("USAGE_PREFIX_SEPARATORS", "_-"),
+		APIKey:                getEnv("API_KEY", "super-secret-key"),
+		RequireAPIKey:         getEnvBool("REQUIRE_API_KEY", true),
+		APIKeysFile:           getEnv("API_KEYS_FILE", ""),
+		PublicRead:            getEnvBool("PUBLIC_READ", false),
+		PublicURL:             strings.TrimSuffix(getEnv("PUBLIC_URL", ""), "/"),
+		TrustedProxies:        getEnvList("TRUSTED_PROXIES", ""),
+		SigningKey:            []byte(getEnv("SIGNING_KEY", "")),
+		SignedURLMaxTTL:       getEnvDuration("SIGNED_URL_MAX_TTL", 7*24*time.Hour),
+		S3:                    getEnvBool("S3", false),
+		S3Endpoint:            getEnv("S3_ENDPOINT", ""),
+		S3AccessKey:           getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:           getEnv("S3_SECRET_KEY", ""),
+		S3Region:              getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:              getEnv("S3_BUCKET", "viespirkiai"),
+		S3PartSize:            getEnvInt64("S3_PART_SIZE", 16*1024*1024),
+		S3UploadConcurrency:   getEnvInt("S3_UPLOAD_CONCURRENCY", 4),
+		TusUploadExpiry:       getEnvDuration("TUS_UPLOAD_EXPIRY", 24*time.Hour),
+		S3Redirect:            getEnvBool("S3_REDIRECT", false),
+		FetchSchemes:          getEnvList("FETCH_ALLOWED_SCHEMES", "http,https"),
+		FetchAllowHosts:       getEnvList("FETCH_ALLOW_HOSTS", ""),
+		FetchDenyHosts:        getEnvList("FETCH_DENY_HOSTS", ""),
+		FetchAllowPrivate:     getEnvBool("FETCH_ALLOW_PRIVATE", false),
+		FetchMaxRedirects:     getEnvInt("FETCH_MAX_REDIRECTS", 5),
+		FetchMaxBytes:         getEnvSize("FETCH_MAX_BYTES", 0),
+		FetchConnectTimeout:   getEnvDuration("FETCH_CONNECT_TIMEOUT", 10*time.Second),
+		FetchTimeout:          getEnvDuration("FETCH_TIMEOUT", time.Hour),
+		FetchAllowedTypes:     getEnvList("FETCH_ALLOWED_TYPES", ""),
+		FetchRetries:          getEnvInt("FETCH_RETRIES", 3),
+		FetchRetryBaseDelay:   getEnvDuration("FETCH_RETRY_BASE_DELAY", time.Second),
+		FetchRetryMaxDelay:    getEnvDuration("FETCH_RETRY_MAX_DELAY", 30*time.Second),
+		BatchMaxItems:         getEnvInt("BATCH_MAX_ITEMS", 500),
+		BatchConcurrency:      getEnvInt("BATCH_CONCURRENCY", 8),
+		BatchHostConcurrency:  getEnvInt("BATCH_HOST_CONCURRENCY", 2),
+		JobWorkers:            getEnvInt("JOB_WORKERS", 4),
+		JobQueueSize:          getEnvInt("JOB_QUEUE_SIZE", 100),
+		JobRetention:          getEnvDuration("JOB_RETENTION", 24*time.Hour),
+		WebhookSecret:         []byte(getEnv("WEBHOOK_SECRET", "")),
+		WebhookMaxAttempts:    getEnvInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookTimeout:        getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		S3RedirectTTL:         getEnvDuration("S3_REDIRECT_TTL", 5*time.Minute),
+	}
+
+	// Zero would leave batch requests and jobs waiting forever
+	for name, value := range map[string]int{
+		"BATCH_CONCURRENCY":      cfg.BatchConcurrency,
+		"BATCH_HOST_CONCURRENCY": cfg.BatchHostConcurrency,
+		"JOB_WORKERS":            cfg.JobWorkers,
+		"JOB_QUEUE_SIZE":         cfg.JobQueueSize,
+	} {
+		if value < 1 {
+			panic(name + " must be at least 1")
+		}
+	}
+
+	// A keys file replaces the single API_KEY, which otherwise may do anything
+	if cfg.APIKeysFile != "" {
+		keys, err := loadKeys(cfg.APIKeysFile)
+		if err != nil {
+			panic("Failed to load API_KEYS_FILE: " + err.Error())
+		}
+		cfg.APIKeys = keys
+	} else {
+		cfg.APIKeys = []APIKey{{Name: "default", Key: cfg.APIKey, Scopes: []string{"admin"}}}
+	}
+
+	// Webhook receivers hold their secret, with the link key they could sign
+	// download links
+	if len(cfg.WebhookSecret) > 0 && string(cfg.WebhookSecret) == string(cfg.SigningKey) {
+		panic("WEBHOOK_SECRET must differ from SIGNING_KEY")
+	}
+
+	// Without a configured secret signed links only last until a restart
+	if len(cfg.SigningKey) == 0 {
+		cfg.SigningKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.SigningKey); err != nil {
+			panic("Failed to generate signing key: " + err.Error())
+		}
+	}
+
+	// Storage quotas, sizes accept K, M, G and T suffixes
+	cfg.QuotaBytes = getEnvSize("QUOTA_BYTES", 0)
+	cfg.QuotaSoftPercent = getEnvInt("QUOTA_SOFT_PERCENT", 90)
+	cfg.KeyQuotas = map[string]int64{}
+	for _, entry := range strings.Split(getEnv("KEY_QUOTAS", ""), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		size, err := ParseSize(value)
+		if err != nil {
+			panic("Invalid KEY_QUOTAS entry " + entry + ": " + err.Error())
+		}
+		cfg.KeyQuotas[strings.TrimSpace(name)] = size
+	}
+	for _, key := range cfg.APIKeys {
+		if _, ok := cfg.KeyQuotas[key.Name]; ok || key.Quota == "" {
+			continue
+		}
+		size, err := ParseSize(key.Quota)
+		if err != nil {
+			panic("Invalid quota for API key " + key.Name + ": " + err.Error())
+		}
+		cfg.KeyQuotas[key.Name] = size
+	}
+
+	// The usage file lives in the storage directory unless given as an absolute path
+	cfg.UsagePath = getEnv("USAGE_FILE", ".usage.json")
+	if !filepath.IsAbs(cfg.UsagePath) {
+		cfg.UsagePath = filepath.Join(cfg.StoragePath, cfg.UsagePath)
 	}
 
 	// Initialize S3 client if S3 is enabled
@@ -61,6 +207,17 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvList splits a comma separated variable, dropping empty entries
+func getEnvList(key, defaultValue string) []string {
+	var list []string
+	for _, entry := range strings.Split(getEnv(key, defaultValue), ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if parsed, err := strconv.ParseBool(value); err == nil {
@@ -69,3 +226,68 @@ func getEnvBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+func getEnvInt64(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvSize(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := ParseSize(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// ParseSize parses a byte count with an optional binary K, M, G or T suffix
+func ParseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
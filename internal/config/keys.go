@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/goccy/go-yaml"
+)
+
+// APIKey is an API key with the name it is logged and accounted under and the
+// scopes it grants
+type APIKey struct {
+	Name   string   `yaml:"name"`
+	Key    string   `yaml:"key"`
+	Scopes []string `yaml:"scopes"`
+	// Quota optionally limits the bytes stored by the key, e.g. "10G"
+	Quota string `yaml:"quota"`
+}
+
+// keysFile is the layout of API_KEYS_FILE. JSON files work as well since
+// YAML is a superset of JSON.
+type keysFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// loadKeys reads the API keys from a YAML or JSON file
+func loadKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file keysFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("%s defines no keys", path)
+	}
+	return file.Keys, nil
+}
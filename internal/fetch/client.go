@@ -0,0 +1,202 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrBlocked is returned for URLs the policy does not allow fetching
+var ErrBlocked = errors.New("URL blocked")
+
+// Policy restricts which URLs may be fetched
+type Policy struct {
+	// Schemes lists the allowed URL schemes
+	Schemes []string
+	// AllowHosts, when not empty, lists the only host names that may be
+	// fetched. "*.example.com" matches every subdomain of example.com.
+	AllowHosts []string
+	// DenyHosts lists host names as above and CIDR ranges that are refused
+	DenyHosts []string
+	// AllowPrivate permits loopback, private and link-local addresses
+	AllowPrivate bool
+	// MaxRedirects caps how many redirects are followed
+	MaxRedirects int
+}
+
+// blockedNets are special purpose ranges not covered by the netip helpers
+var blockedNets = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// newClient returns an HTTP client enforcing the policy. Addresses are
+// checked when connecting, so every resolved IP is covered, including those
+// of redirect targets and hosts whose DNS changes between lookups.
+func newClient(policy Policy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return blocked("cannot parse address %s", address)
+			}
+			return policy.checkAddr(addrPort.Addr())
+		},
+	}
+
+	transport := &http.Transport{
+		// A proxy would connect on our behalf and bypass the address checks
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if timeout, ok := ctx.Value(connectTimeoutKey{}).(time.Duration); ok {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return dialer.DialContext(ctx, network, address)
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > policy.MaxRedirects {
+				return blocked("more than %d redirects", policy.MaxRedirects)
+			}
+			// Go only drops Authorization and Cookie for another host, not
+			// the other credentials a caller may have set
+			if req.URL.Host != via[0].URL.Host {
+				for name := range req.Header {
+					if isSensitiveHeader(name) {
+						req.Header.Del(name)
+					}
+				}
+			}
+			return policy.checkURL(req.URL)
+		},
+	}
+}
+
+// checkURL validates the scheme and host name of a URL before connecting
+func (p Policy) checkURL(u *url.URL) error {
+	if !slices.Contains(p.Schemes, strings.ToLower(u.Scheme)) {
+		return blocked("scheme %q is not allowed", u.Scheme)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return blocked("URL has no host")
+	}
+
+	for _, pattern := range p.DenyHosts {
+		if matchHost(pattern, host) {
+			return blocked("host %s is denied", host)
+		}
+	}
+	if len(p.AllowHosts) > 0 && !slices.ContainsFunc(p.AllowHosts, func(pattern string) bool {
+		return matchHost(pattern, host)
+	}) {
+		return blocked("host %s is not in the allowlist", host)
+	}
+
+	// Literal addresses can be refused before any connection attempt
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddr(addr)
+	}
+	return nil
+}
+
+// checkAddr validates an address that is about to be connected to
+func (p Policy) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+
+	for _, pattern := range p.DenyHosts {
+		if prefix, err := netip.ParsePrefix(pattern); err == nil && prefix.Contains(addr) {
+			return blocked("address %s is in denied range %s", addr, prefix)
+		}
+	}
+
+	if p.AllowPrivate {
+		return nil
+	}
+	switch {
+	case addr.IsLoopback():
+		return blocked("address %s is a loopback address", addr)
+	case addr.IsPrivate():
+		return blocked("address %s is a private address", addr)
+	case addr.IsLinkLocalUnicast(), addr.IsLinkLocalMulticast(), addr.IsInterfaceLocalMulticast():
+		return blocked("address %s is a link-local address", addr)
+	case addr.IsUnspecified(), addr.IsMulticast():
+		return blocked("address %s is not a unicast address", addr)
+	}
+	for _, prefix := range blockedNets {
+		if prefix.Contains(addr) {
+			return blocked("address %s is in reserved range %s", addr, prefix)
+		}
+	}
+	return nil
+}
+
+// matchHost reports whether host matches a host name pattern. CIDR patterns
+// never match names, they are checked against addresses.
+func matchHost(pattern, host string) bool {
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
+
+func blocked(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrBlocked, fmt.Sprintf(format, args...))
+}
+
+// do sends req after checking its URL against the policy
+func (f *Fetcher) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if err := f.policy.checkURL(req.URL); err != nil {
+		return nil, err
+	}
+	return f.client.Do(req.WithContext(ctx))
+}
+
+// CheckURL validates a URL the service will connect to on its own, such as a
+// callback, against the same policy as fetched URLs
+func (f *Fetcher) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return blocked("cannot parse URL")
+	}
+	return f.policy.checkURL(u)
+}
+
+// CallbackClient returns a client for requests to URLs passed by callers. It
+// connects under the fetch policy and does not follow redirects, so a
+// receiver cannot send the request on to an internal address.
+func (f *Fetcher) CallbackClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: f.client.Transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
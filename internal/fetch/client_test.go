@@ -0,0 +1,183 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCheckURL(t *testing.T) {
+	policy := Policy{
+		Schemes:   []string{"http", "https"},
+		DenyHosts: []string{"evil.example", "*.internal.example", "203.0.113.0/24"},
+	}
+	allowlisted := policy
+	allowlisted.AllowHosts = []string{"files.example.com", "*.cdn.example"}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		url     string
+		blocked bool
+	}{
+		{"public host", policy, "https://example.com/a.pdf", false},
+		{"uppercase scheme", policy, "HTTPS://example.com/", false},
+		{"public address", policy, "http://93.184.216.34/", false},
+		{"scheme not allowed", policy, "ftp://example.com/", true},
+		{"file scheme", policy, "file:///etc/passwd", true},
+		{"no host", policy, "http:///path", true},
+		{"denied host", policy, "http://evil.example/", true},
+		{"denied host trailing dot", policy, "http://EVIL.example./", true},
+		{"denied wildcard", policy, "http://db.internal.example/", true},
+		{"wildcard needs a subdomain", policy, "http://internal.example/", false},
+		{"denied range", policy, "http://203.0.113.9/", true},
+		{"loopback", policy, "http://127.0.0.1/", true},
+		{"loopback ipv6", policy, "http://[::1]/", true},
+		{"ipv4-mapped loopback", policy, "http://[::ffff:127.0.0.1]/", true},
+		{"ipv4-mapped private", policy, "http://[::ffff:10.0.0.1]/", true},
+		{"private", policy, "http://192.168.1.1/", true},
+		{"metadata endpoint", policy, "http://169.254.169.254/latest/meta-data/", true},
+		{"nat64", policy, "http://[64:ff9b::a9fe:a9fe]/", true},
+		{"unspecified", policy, "http://0.0.0.0/", true},
+		{"allowlisted host", allowlisted, "https://files.example.com/a", false},
+		{"allowlisted wildcard", allowlisted, "https://eu.cdn.example/a", false},
+		{"not allowlisted", allowlisted, "https://example.com/a", true},
+		{"denied before allowed", Policy{Schemes: []string{"http"}, AllowHosts: []string{"*.example"}, DenyHosts: []string{"evil.example"}}, "http://evil.example/", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.policy.checkURL(u)
+			if blocked := errors.Is(err, ErrBlocked); blocked != tt.blocked {
+				t.Errorf("checkURL(%s) = %v, want blocked %v", tt.url, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	strict := Policy{DenyHosts: []string{"203.0.113.0/24", "2001:db8:1::/48"}}
+	permissive := strict
+	permissive.AllowPrivate = true
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		addr    string
+		blocked bool
+	}{
+		{"public", strict, "93.184.216.34", false},
+		{"public ipv6", strict, "2606:2800:220:1:248:1893:25c8:1946", false},
+		{"loopback", strict, "127.0.0.53", true},
+		{"ipv4-mapped loopback", strict, "::ffff:127.0.0.1", true},
+		{"ipv4-mapped public", strict, "::ffff:93.184.216.34", false},
+		{"private 10/8", strict, "10.1.2.3", true},
+		{"private 172.16/12", strict, "172.31.255.255", true},
+		{"unique local", strict, "fd00::1", true},
+		{"link-local", strict, "169.254.169.254", true},
+		{"link-local ipv6", strict, "fe80::1", true},
+		{"this network", strict, "0.1.2.3", true},
+		{"carrier-grade nat", strict, "100.64.0.1", true},
+		{"benchmarking", strict, "198.18.0.1", true},
+		{"reserved", strict, "240.0.0.1", true},
+		{"nat64 of metadata endpoint", strict, "64:ff9b::a9fe:a9fe", true},
+		{"multicast", strict, "224.0.0.1", true},
+		{"denied range", strict, "203.0.113.200", true},
+		{"denied ipv6 range", strict, "2001:db8:1::5", true},
+		{"ipv4-mapped denied range", strict, "::ffff:203.0.113.1", true},
+		{"private allowed", permissive, "10.1.2.3", false},
+		{"loopback allowed", permissive, "127.0.0.1", false},
+		{"denied range despite private allowed", permissive, "203.0.113.1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.checkAddr(netip.MustParseAddr(tt.addr))
+			if blocked := errors.Is(err, ErrBlocked); blocked != tt.blocked {
+				t.Errorf("checkAddr(%s) = %v, want blocked %v", tt.addr, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		want          bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"10.0.0.0/8", "10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHost(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.URL.Query().Get("to"); target != "" {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		received <- r.Header.Clone()
+	}))
+	defer server.Close()
+
+	port := server.URL[strings.LastIndex(server.URL, ":")+1:]
+	client := newClient(Policy{Schemes: []string{"http"}, AllowPrivate: true, MaxRedirects: 5})
+
+	tests := []struct {
+		name    string
+		target  string
+		secrets bool
+	}{
+		{"same host", server.URL + "/final", true},
+		{"other host", "http://localhost:" + port + "/final", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/?to="+url.QueryEscape(tt.target), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Auth-Token", "s3cr3t")
+			req.Header.Set("X-Api-Key", "k")
+			req.Header.Set("Accept-Language", "lt")
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			header := <-received
+			for _, name := range []string{"X-Auth-Token", "X-Api-Key"} {
+				if sent := header.Get(name) != ""; sent != tt.secrets {
+					t.Errorf("%s sent = %v, want %v", name, sent, tt.secrets)
+				}
+			}
+			if header.Get("Accept-Language") == "" {
+				t.Error("Accept-Language was not sent")
+			}
+		})
+	}
+}
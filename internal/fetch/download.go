@@ -0,0 +1,380 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"goviesdeze/internal/quota"
+)
+
+// RetryPolicy configures how transient failures are retried
+type RetryPolicy struct {
+	// Retries is how often a failed attempt is repeated
+	Retries int
+	// BaseDelay is the wait before the first retry, doubled for every
+	// further one and randomized by up to half
+	BaseDelay time.Duration
+	// MaxDelay caps the wait. A longer Retry-After ends the retries.
+	MaxDelay time.Duration
+}
+
+// retryableError marks a failure that may succeed when tried again
+type retryableError struct {
+	err error
+	// after is the wait the server asked for with Retry-After
+	after time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// retryableStatuses are responses that indicate a transient problem
+var retryableStatuses = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooEarly:            true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// download writes a remote file into a local file. Failed attempts are
+// retried, continuing with a Range request where the origin supports it and
+// the file provably did not change in between.
+type download struct {
+	fetcher  *Fetcher
+	req      Request
+	limits   Limits
+	file     *os.File
+	hash     hash.Hash
+	progress *Progress
+
+	// reservation holds the quota for the file and body feeds the bytes of
+	// the current attempt through the size and quota checks
+	reservation *quota.Reservation
+	body        *switchReader
+	source      io.Reader
+
+	written      int64
+	total        int64
+	etag         string
+	lastModified string
+	resumable    bool
+	contentType  string
+}
+
+// run downloads the file, retrying until it succeeds, a permanent error
+// occurs or the retries are used up. The quota stays reserved until release
+// is called.
+func (d *download) run(ctx context.Context) error {
+	policy := d.fetcher.retry
+	for attempt := 0; ; attempt++ {
+		err := d.attempt(ctx)
+		if err == nil {
+			return nil
+		}
+
+		var retry *retryableError
+		if !errors.As(err, &retry) {
+			return err
+		}
+		if attempt >= policy.Retries || ctx.Err() != nil {
+			return retry.err
+		}
+
+		delay := backoff(policy, attempt)
+		if retry.after > 0 {
+			if retry.after > policy.MaxDelay {
+				return retry.err
+			}
+			delay = retry.after
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return retry.err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends one request and appends the body to the file
+func (d *download) attempt(ctx context.Context) error {
+	resuming := d.written > 0 && d.resumable
+	if d.written > 0 && !resuming {
+		if err := d.restart(); err != nil {
+			return err
+		}
+	}
+
+	httpReq, err := d.newRequest(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFetchFailed, err)
+	}
+	if resuming {
+		httpReq.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+		httpReq.Header.Set("If-Range", d.validator())
+	}
+
+	resp, err := d.fetcher.do(ctx, httpReq)
+	if err != nil {
+		if errors.Is(err, ErrBlocked) {
+			return blockedCause(err)
+		}
+		// A request that may have reached the origin is only repeated when
+		// doing so is harmless
+		if ctx.Err() != nil || (!d.idempotent() && !dialFailed(err)) {
+			return fmt.Errorf("%w: %v", ErrFetchFailed, err)
+		}
+		return &retryableError{err: fmt.Errorf("%w: %v", ErrFetchFailed, err)}
+	}
+	defer resp.Body.Close()
+
+	statusErr := fmt.Errorf("%w: %s: %s", ErrFetchFailed, RedactURL(d.req.URL), resp.Status)
+	switch {
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		if !d.continues(resp) {
+			// Start over on the next attempt rather than mixing versions
+			d.resumable = false
+			return &retryableError{err: fmt.Errorf("%w: %s changed while resuming", ErrFetchFailed, RedactURL(d.req.URL))}
+		}
+		d.body.r = resp.Body
+	case resuming && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		d.resumable = false
+		return &retryableError{err: statusErr}
+	case resp.StatusCode == http.StatusOK:
+		// Also when resuming: the origin ignored the range or the file changed
+		if err := d.restart(); err != nil {
+			return err
+		}
+		if err := d.start(resp); err != nil {
+			return err
+		}
+	case retryableStatuses[resp.StatusCode] && d.idempotent():
+		return &retryableError{err: statusErr, after: retryAfter(resp)}
+	default:
+		return statusErr
+	}
+
+	if _, err := io.Copy(io.MultiWriter(d.file, d.hash, d), d.source); err != nil {
+		if d.reservation.Exceeded() {
+			return quota.ErrQuotaExceeded
+		}
+		if errors.Is(err, ErrTooLarge) {
+			return err
+		}
+		err = fmt.Errorf("%w: %v", ErrFetchFailed, err)
+		if ctx.Err() != nil || !d.idempotent() {
+			return err
+		}
+		return &retryableError{err: err}
+	}
+	return nil
+}
+
+// idempotent reports whether the request may be sent again although the
+// origin possibly acted on it already. POST requests are not.
+func (d *download) idempotent() bool {
+	return d.req.Method != http.MethodPost
+}
+
+// newRequest builds the outbound request. The body is recreated for every
+// attempt.
+func (d *download) newRequest(ctx context.Context) (*http.Request, error) {
+	method := d.req.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var requestBody io.Reader
+	if d.req.Body != "" {
+		requestBody = strings.NewReader(d.req.Body)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, d.req.URL, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range d.req.Headers {
+		httpReq.Header.Set(name, value)
+	}
+	// Without this the transport asks for gzip and decompresses, and a later
+	// Range would address the compressed bytes instead of the ones written
+	if httpReq.Header.Get("Accept-Encoding") == "" {
+		httpReq.Header.Set("Accept-Encoding", "identity")
+	}
+	if d.req.BasicAuth != nil {
+		httpReq.SetBasicAuth(d.req.BasicAuth.Username, d.req.BasicAuth.Password)
+	}
+	return httpReq, nil
+}
+
+// start checks a complete response before its body is read and remembers
+// what is needed to resume it
+func (d *download) start(resp *http.Response) error {
+	d.total = resp.ContentLength
+	d.progress.Total.Store(resp.ContentLength)
+	d.contentType = resp.Header.Get("Content-Type")
+	d.etag = resp.Header.Get("ETag")
+	d.lastModified = resp.Header.Get("Last-Modified")
+	d.resumable = d.req.Method != http.MethodPost &&
+		!resp.Uncompressed &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		d.validator() != ""
+
+	// Refuse oversized files before reading them when the size is announced
+	d.body = &switchReader{r: resp.Body}
+	d.source = d.body
+	if d.limits.MaxBytes > 0 {
+		if resp.ContentLength > d.limits.MaxBytes {
+			return fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrTooLarge, resp.ContentLength, d.limits.MaxBytes)
+		}
+		d.source = &limitReader{r: d.source, max: d.limits.MaxBytes}
+	}
+
+	// Check the actual type of the contents, the Content-Type header is
+	// chosen by the remote server
+	if len(d.fetcher.limits.AllowedTypes) > 0 || len(d.limits.AllowedTypes) > 0 {
+		sniffed, sniffedBody, err := sniffType(d.source)
+		if err != nil {
+			if errors.Is(err, ErrTooLarge) {
+				return err
+			}
+			if !d.idempotent() {
+				return fmt.Errorf("%w: %v", ErrFetchFailed, err)
+			}
+			return &retryableError{err: fmt.Errorf("%w: %v", ErrFetchFailed, err)}
+		}
+		if !typeAllowed(sniffed, d.fetcher.limits.AllowedTypes) || !typeAllowed(sniffed, d.limits.AllowedTypes) {
+			return fmt.Errorf("%w: %s", ErrTypeNotAllowed, sniffed)
+		}
+		d.source = sniffedBody
+	}
+
+	// The advertised size is checked up front, the rest while streaming
+	reservation, err := quota.Reserve(d.req.Owner, resp.ContentLength, nil)
+	if err != nil {
+		return err
+	}
+	d.reservation = reservation
+	d.source = reservation.Reader(d.source)
+	return nil
+}
+
+// continues reports whether a partial response carries the rest of the file
+// that was partly downloaded
+func (d *download) continues(resp *http.Response) bool {
+	if d.etag != "" && resp.Header.Get("ETag") != d.etag {
+		return false
+	}
+	if d.lastModified != "" && resp.Header.Get("Last-Modified") != d.lastModified {
+		return false
+	}
+
+	var start, end, total int64
+	contentRange := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &total); err != nil {
+		// The total may be unknown, written as *
+		if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/*", &start, &end); err != nil {
+			return false
+		}
+		total = -1
+	}
+	return start == d.written && (d.total < 0 || total == d.total)
+}
+
+// validator returns the value for If-Range. Weak ETags may not be used for
+// ranges, so Last-Modified is the fallback.
+func (d *download) validator() string {
+	if d.etag != "" && !strings.HasPrefix(d.etag, "W/") {
+		return d.etag
+	}
+	return d.lastModified
+}
+
+// restart discards what was downloaded so far
+func (d *download) restart() error {
+	if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+	if err := d.file.Truncate(0); err != nil {
+		return fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+	d.hash.Reset()
+	d.written = 0
+	d.progress.Downloaded.Store(0)
+	d.resumable = false
+	d.release()
+	return nil
+}
+
+// release returns the quota reserved for the download
+func (d *download) release() {
+	if d.reservation != nil {
+		d.reservation.Release()
+		d.reservation = nil
+	}
+}
+
+// Write counts the bytes stored so far
+func (d *download) Write(p []byte) (int, error) {
+	d.written += int64(len(p))
+	d.progress.Downloaded.Store(d.written)
+	return len(p), nil
+}
+
+// switchReader reads from the body of the current attempt
+type switchReader struct {
+	r io.Reader
+}
+
+func (s *switchReader) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// dialFailed reports whether err happened while connecting, before anything
+// was sent
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// backoff returns the randomized wait before retry number attempt+1
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 0; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, policy.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryAfter parses the Retry-After header, given in seconds or as a date
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package fetch
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+)
+
+var (
+	// ErrFetchFailed is returned when the remote file could not be downloaded
+	ErrFetchFailed = errors.New("failed to fetch URL")
+	// ErrStoreFailed is returned when the downloaded file could not be stored
+	ErrStoreFailed = errors.New("failed to store file")
+)
+
+// Request describes a remote file to store
+type Request struct {
+	URL string
+	// Owner is the API key name the stored file is accounted to
+	Owner string
+	// Method defaults to GET. Body is sent with POST requests.
+	Method string
+	Body   string
+	// Headers are sent with the request to the remote server
+	Headers   map[string]string
+	BasicAuth *BasicAuth
+	// Limits tightens the configured limits for this fetch
+	Limits Limits
+}
+
+// BasicAuth holds credentials for HTTP basic authentication
+type BasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Result describes the stored file
+type Result struct {
+	MD5         string
+	Size        int64
+	ContentType string
+	// Existing is set when a file with the same contents was already stored
+	Existing bool
+}
+
+// Progress reports how far a fetch got. It is safe to read while the fetch
+// is running.
+type Progress struct {
+	Downloaded atomic.Int64
+	// Total is the size announced by the remote server, or -1 if unknown
+	Total atomic.Int64
+}
+
+// Fetcher downloads remote files into storage under the md5 of their contents
+type Fetcher struct {
+	cfg    *config.Config
+	store  storage.Backend
+	policy Policy
+	limits Limits
+	client *http.Client
+	retry  RetryPolicy
+}
+
+// New creates a fetcher storing files in store
+func New(cfg *config.Config, store storage.Backend) *Fetcher {
+	policy := Policy{
+		Schemes:      cfg.FetchSchemes,
+		AllowHosts:   cfg.FetchAllowHosts,
+		DenyHosts:    cfg.FetchDenyHosts,
+		AllowPrivate: cfg.FetchAllowPrivate,
+		MaxRedirects: cfg.FetchMaxRedirects,
+	}
+	limits := Limits{
+		MaxBytes:       cfg.FetchMaxBytes,
+		ConnectTimeout: cfg.FetchConnectTimeout,
+		Timeout:        cfg.FetchTimeout,
+		AllowedTypes:   cfg.FetchAllowedTypes,
+	}
+	retry := RetryPolicy{
+		Retries:   cfg.FetchRetries,
+		BaseDelay: cfg.FetchRetryBaseDelay,
+		MaxDelay:  cfg.FetchRetryMaxDelay,
+	}
+	return &Fetcher{cfg: cfg, store: store, policy: policy, limits: limits, client: newClient(policy), retry: retry}
+}
+
+// Fetch downloads req.URL and stores it. progress may be nil.
+func (f *Fetcher) Fetch(ctx context.Context, req Request, progress *Progress) (*Result, error) {
+	if progress == nil {
+		progress = &Progress{}
+	}
+	progress.Total.Store(-1)
+	limits := req.Limits.within(f.limits)
+
+	// The time limit covers the download, not storing the file afterwards
+	downloadCtx := withConnectTimeout(ctx, limits.ConnectTimeout)
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		downloadCtx, cancel = context.WithTimeout(downloadCtx, limits.Timeout)
+		defer cancel()
+	}
+	timedOut := func(err error) error {
+		if errors.Is(downloadCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return fmt.Errorf("%w after %s", ErrTimeout, limits.Timeout)
+		}
+		return err
+	}
+
+	// Create temporary file, the final name is only known once the hash is
+	tmpFile, err := os.CreateTemp(f.cfg.StoragePath, "tmp_*")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	// Calculate MD5 hash while writing
+	hash := md5.New()
+	d := &download{fetcher: f, req: req, limits: limits, file: tmpFile, hash: hash, progress: progress}
+	defer d.release()
+	if err := d.run(downloadCtx); err != nil {
+		tmpFile.Close()
+		return nil, timedOut(err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+	tmpFile.Close()
+
+	md5sum := fmt.Sprintf("%x", hash.Sum(nil))
+	key := utils.ShardKey(md5sum)
+
+	// Check if file already exists
+	if existing, err := f.store.Stat(ctx, key); err == nil {
+		return &Result{MD5: md5sum, Size: existing.Size, ContentType: existing.ContentType, Existing: true}, nil
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+
+	// Move temp file into storage
+	info, err := storage.PutFile(ctx, f.store, key, tmpFile.Name(), storage.PutOptions{
+		ContentType: d.contentType,
+		MD5:         md5sum,
+		Owner:       req.Owner,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrStoreFailed, err)
+	}
+
+	// Update usage, a concurrent fetch of the same content may have stored
+	// it first
+	storage.RecordPut(info)
+
+	return &Result{MD5: md5sum, Size: info.Size, ContentType: info.ContentType}, nil
+}
+
+// blockedCause strips the request and connection details wrapped around a
+// policy error so only the reason is reported
+func blockedCause(err error) error {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil || next == ErrBlocked || !errors.Is(next, ErrBlocked) {
+			return err
+		}
+		err = next
+	}
+}
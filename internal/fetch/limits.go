@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/h2non/filetype"
+)
+
+var (
+	// ErrTooLarge is returned when the remote file exceeds the size limit
+	ErrTooLarge = errors.New("file too large")
+	// ErrTypeNotAllowed is returned when the sniffed type is not allowed
+	ErrTypeNotAllowed = errors.New("content type not allowed")
+	// ErrTimeout is returned when a fetch exceeds its time limit
+	ErrTimeout = errors.New("fetch timed out")
+)
+
+// sniffLen is how many bytes are inspected to detect the content type
+const sniffLen = 512
+
+// Limits bounds a single fetch. Zero values mean no limit.
+type Limits struct {
+	MaxBytes       int64
+	ConnectTimeout time.Duration
+	// Timeout bounds the whole download including reading the body
+	Timeout time.Duration
+	// AllowedTypes lists MIME types such as "application/pdf" or "image/*"
+	AllowedTypes []string
+}
+
+// within returns the stricter of two limits. The allowed types of both
+// apply, so they are checked separately.
+func (l Limits) within(global Limits) Limits {
+	return Limits{
+		MaxBytes:       stricter(l.MaxBytes, global.MaxBytes),
+		ConnectTimeout: stricter(l.ConnectTimeout, global.ConnectTimeout),
+		Timeout:        stricter(l.Timeout, global.Timeout),
+		AllowedTypes:   l.AllowedTypes,
+	}
+}
+
+// stricter returns the smaller of two limits where zero is unlimited
+func stricter[T int64 | time.Duration](a, b T) T {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// sniffType detects the content type from the first bytes of body. The
+// returned reader still yields the complete body.
+func sniffType(body io.Reader) (string, io.Reader, error) {
+	buffered := bufio.NewReaderSize(body, sniffLen)
+	head, err := buffered.Peek(sniffLen)
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return "", nil, err
+	}
+
+	if kind, _ := filetype.Match(head); kind != filetype.Unknown {
+		return kind.MIME.Value, buffered, nil
+	}
+	// filetype only knows binary formats, fall back for text and the like
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType, buffered, nil
+}
+
+// typeAllowed reports whether contentType matches one of the patterns. An
+// empty list allows every type.
+func typeAllowed(contentType string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(contentType, prefix+"/") {
+				return true
+			}
+		} else if pattern == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// limitReader fails with ErrTooLarge once more than max bytes were read
+type limitReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, fmt.Errorf("%w: more than %d bytes", ErrTooLarge, l.max)
+	}
+	return n, err
+}
+
+// connectTimeoutKey carries the connect timeout of a fetch to the dialer
+type connectTimeoutKey struct{}
+
+// withConnectTimeout sets the connect timeout used by the dialer
+func withConnectTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	if timeout <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, connectTimeoutKey{}, timeout)
+}
@@ -0,0 +1,49 @@
+package fetch
+
+import (
+	"net/url"
+	"strings"
+)
+
+// redacted replaces sensitive values in job records, errors and logs
+const redacted = "[REDACTED]"
+
+// sensitiveHeaderParts mark header names whose values are secrets
+var sensitiveHeaderParts = []string{"auth", "cookie", "token", "secret", "key", "password", "session"}
+
+// RedactHeaders returns a copy of headers with the values of credentials,
+// cookies and similar headers replaced
+func RedactHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	result := make(map[string]string, len(headers))
+	for name, value := range headers {
+		result[name] = value
+		if isSensitiveHeader(name) {
+			result[name] = redacted
+		}
+	}
+	return result
+}
+
+// isSensitiveHeader reports whether the value of a header is a secret
+func isSensitiveHeader(name string) bool {
+	lower := strings.ToLower(name)
+	for _, part := range sensitiveHeaderParts {
+		if strings.Contains(lower, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactURL hides the password of a URL carrying credentials
+func RedactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,149 @@
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/fetch"
+	"goviesdeze/internal/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchDownloadRequest represents the request body for the batch endpoint
+type BatchDownloadRequest struct {
+	Items []FetchOptions `json:"items"`
+}
+
+// BatchResult is the outcome of one item of a batch
+type BatchResult struct {
+	// Index is the position of the item in the request
+	Index    int    `json:"index"`
+	URL      string `json:"url"`
+	Status   int    `json:"status"`
+	MD5      string `json:"md5,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Existing bool   `json:"existing,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DownloadURLBatch fetches many URLs concurrently, limiting how many run at
+// once in total and per host. Results are returned in request order, or
+// streamed as NDJSON in completion order when the client accepts it.
+func DownloadURLBatch(cfg *config.Config, fetcher *fetch.Fetcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchDownloadRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if len(req.Items) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing items"})
+			return
+		}
+		if len(req.Items) > cfg.BatchMaxItems {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d items per batch", cfg.BatchMaxItems)})
+			return
+		}
+
+		results := make(chan BatchResult)
+		go func() {
+			runBatch(c, cfg, fetcher, req.Items, results)
+			close(results)
+		}()
+
+		if !wantsNDJSON(c) {
+			collected := make([]BatchResult, len(req.Items))
+			for result := range results {
+				collected[result.Index] = result
+			}
+			c.JSON(http.StatusOK, gin.H{"results": collected})
+			return
+		}
+
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		for result := range results {
+			encoder.Encode(result)
+			c.Writer.Flush()
+		}
+	}
+}
+
+// runBatch fetches every item and sends its result. A fetch first waits for
+// a slot of its host and then for a global one, so a slow host cannot hold
+// slots that other hosts could use.
+func runBatch(c *gin.Context, cfg *config.Config, fetcher *fetch.Fetcher, items []FetchOptions, results chan<- BatchResult) {
+	ctx := c.Request.Context()
+	owner := middleware.KeyName(c)
+	global := make(chan struct{}, cfg.BatchConcurrency)
+
+	var hostsMu sync.Mutex
+	hosts := map[string]chan struct{}{}
+	hostSlots := func(rawURL string) chan struct{} {
+		host := rawURL
+		if u, err := url.Parse(rawURL); err == nil {
+			host = strings.ToLower(u.Host)
+		}
+
+		hostsMu.Lock()
+		defer hostsMu.Unlock()
+		if hosts[host] == nil {
+			hosts[host] = make(chan struct{}, cfg.BatchHostConcurrency)
+		}
+		return hosts[host]
+	}
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := BatchResult{Index: i, URL: fetch.RedactURL(item.URL)}
+
+			if item.URL == "" {
+				result.Status = http.StatusBadRequest
+				result.Error = "Missing url field"
+				results <- result
+				return
+			}
+			fetchReq, err := item.request(owner)
+			if err != nil {
+				result.Status = http.StatusBadRequest
+				result.Error = err.Error()
+				results <- result
+				return
+			}
+
+			host := hostSlots(item.URL)
+			host <- struct{}{}
+			global <- struct{}{}
+			fetched, err := fetcher.Fetch(ctx, fetchReq, nil)
+			<-global
+			<-host
+
+			if err != nil {
+				result.Status = fetchErrorStatus(err)
+				result.Error = fetchErrorMessage(err)
+			} else {
+				result.Status = http.StatusOK
+				result.MD5 = fetched.MD5
+				result.Size = fetched.Size
+				result.Existing = fetched.Existing
+			}
+			results <- result
+		}()
+	}
+	wg.Wait()
+}
+
+// wantsNDJSON reports whether results should be streamed as they complete
+func wantsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
@@ -0,0 +1,127 @@
+package file
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	errInvalidChecksum     = errors.New("invalid checksum header")
+	errConflictingChecksum = errors.New("conflicting checksum headers")
+)
+
+// requestChecksums holds the raw digests a client asked the server to verify
+type requestChecksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+// parseRequestChecksums collects digests from Content-MD5, Digest,
+// Repr-Digest and X-Checksum-SHA256. Unknown algorithms are ignored.
+func parseRequestChecksums(header http.Header) (*requestChecksums, error) {
+	sums := &requestChecksums{}
+
+	if value := header.Get("Content-MD5"); value != "" {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errInvalidChecksum
+		}
+		if err := sums.set("md5", digest); err != nil {
+			return nil, err
+		}
+	}
+
+	// Digest: MD5=<base64>, SHA-256=<base64> (RFC 3230)
+	for _, item := range splitList(header.Values("Digest")) {
+		algorithm, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errInvalidChecksum
+		}
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errInvalidChecksum
+		}
+		if err := sums.set(strings.ToLower(strings.TrimSpace(algorithm)), digest); err != nil {
+			return nil, err
+		}
+	}
+
+	// Repr-Digest: sha-256=:<base64>: (RFC 9530)
+	for _, item := range splitList(header.Values("Repr-Digest")) {
+		algorithm, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, errInvalidChecksum
+		}
+		value, _, _ = strings.Cut(value, ";")
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, errInvalidChecksum
+		}
+		digest, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, errInvalidChecksum
+		}
+		if err := sums.set(strings.ToLower(strings.TrimSpace(algorithm)), digest); err != nil {
+			return nil, err
+		}
+	}
+
+	// X-Checksum-SHA256 is hex encoded, but base64 is accepted as well
+	if value := strings.TrimSpace(header.Get("X-Checksum-SHA256")); value != "" {
+		digest, err := hex.DecodeString(value)
+		if err != nil {
+			if digest, err = base64.StdEncoding.DecodeString(value); err != nil {
+				return nil, errInvalidChecksum
+			}
+		}
+		if err := sums.set("sha-256", digest); err != nil {
+			return nil, err
+		}
+	}
+
+	return sums, nil
+}
+
+// set records a digest, rejecting malformed or contradicting values
+func (s *requestChecksums) set(algorithm string, digest []byte) error {
+	var target *[]byte
+	switch algorithm {
+	case "md5":
+		if len(digest) != md5.Size {
+			return errInvalidChecksum
+		}
+		target = &s.md5
+	case "sha-256":
+		if len(digest) != sha256.Size {
+			return errInvalidChecksum
+		}
+		target = &s.sha256
+	default:
+		return nil
+	}
+
+	if *target != nil && !bytes.Equal(*target, digest) {
+		return errConflictingChecksum
+	}
+	*target = digest
+	return nil
+}
+
+// splitList splits comma separated header values into trimmed items
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
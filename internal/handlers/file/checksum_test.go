@@ -0,0 +1,66 @@
+package file
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseRequestChecksums(t *testing.T) {
+	md5Sum := md5.Sum([]byte("hello"))
+	sha256Sum := sha256.Sum256([]byte("hello"))
+	otherMD5 := md5.Sum([]byte("other"))
+	otherSHA256 := sha256.Sum256([]byte("other"))
+
+	md5B64 := base64.StdEncoding.EncodeToString(md5Sum[:])
+	sha256B64 := base64.StdEncoding.EncodeToString(sha256Sum[:])
+	otherMD5B64 := base64.StdEncoding.EncodeToString(otherMD5[:])
+	otherSHA256B64 := base64.StdEncoding.EncodeToString(otherSHA256[:])
+
+	tests := []struct {
+		name   string
+		header http.Header
+		want   *requestChecksums
+		err    error
+	}{
+		{"none", http.Header{}, &requestChecksums{}, nil},
+		{"content-md5", http.Header{"Content-Md5": {md5B64}}, &requestChecksums{md5: md5Sum[:]}, nil},
+		{"digest", http.Header{"Digest": {"MD5=" + md5B64 + ", SHA-256=" + sha256B64}}, &requestChecksums{md5: md5Sum[:], sha256: sha256Sum[:]}, nil},
+		{"digest lowercase algorithm", http.Header{"Digest": {"sha-256=" + sha256B64}}, &requestChecksums{sha256: sha256Sum[:]}, nil},
+		{"digest unknown algorithm", http.Header{"Digest": {"SHA=" + md5B64}}, &requestChecksums{}, nil},
+		{"repr-digest", http.Header{"Repr-Digest": {"sha-256=:" + sha256B64 + ":"}}, &requestChecksums{sha256: sha256Sum[:]}, nil},
+		{"repr-digest parameters", http.Header{"Repr-Digest": {"sha-256=:" + sha256B64 + ":;q=1"}}, &requestChecksums{sha256: sha256Sum[:]}, nil},
+		{"x-checksum-sha256 hex", http.Header{"X-Checksum-Sha256": {hex.EncodeToString(sha256Sum[:])}}, &requestChecksums{sha256: sha256Sum[:]}, nil},
+		{"x-checksum-sha256 base64", http.Header{"X-Checksum-Sha256": {sha256B64}}, &requestChecksums{sha256: sha256Sum[:]}, nil},
+		{"agreeing headers", http.Header{"Content-Md5": {md5B64}, "Digest": {"MD5=" + md5B64}, "Repr-Digest": {"sha-256=:" + sha256B64 + ":"}, "X-Checksum-Sha256": {hex.EncodeToString(sha256Sum[:])}}, &requestChecksums{md5: md5Sum[:], sha256: sha256Sum[:]}, nil},
+
+		{"conflicting content-md5 and digest", http.Header{"Content-Md5": {md5B64}, "Digest": {"MD5=" + otherMD5B64}}, nil, errConflictingChecksum},
+		{"conflicting content-md5 and repr-digest", http.Header{"Content-Md5": {md5B64}, "Repr-Digest": {"md5=:" + otherMD5B64 + ":"}}, nil, errConflictingChecksum},
+		{"conflicting repr-digest and x-checksum", http.Header{"Repr-Digest": {"sha-256=:" + sha256B64 + ":"}, "X-Checksum-Sha256": {otherSHA256B64}}, nil, errConflictingChecksum},
+
+		{"content-md5 not base64", http.Header{"Content-Md5": {"not base64!"}}, nil, errInvalidChecksum},
+		{"content-md5 wrong length", http.Header{"Content-Md5": {sha256B64}}, nil, errInvalidChecksum},
+		{"digest without value", http.Header{"Digest": {"MD5"}}, nil, errInvalidChecksum},
+		{"digest not base64", http.Header{"Digest": {"SHA-256=%%%"}}, nil, errInvalidChecksum},
+		{"repr-digest without colons", http.Header{"Repr-Digest": {"sha-256=" + sha256B64}}, nil, errInvalidChecksum},
+		{"repr-digest wrong length", http.Header{"Repr-Digest": {"sha-256=:" + md5B64 + ":"}}, nil, errInvalidChecksum},
+		{"x-checksum-sha256 malformed", http.Header{"X-Checksum-Sha256": {"xyz"}}, nil, errInvalidChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRequestChecksums(tt.header)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseRequestChecksums() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRequestChecksums() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
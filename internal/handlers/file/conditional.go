@@ -0,0 +1,124 @@
+package file
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"goviesdeze/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setValidators emits the ETag and Last-Modified headers for an object
+func setValidators(c *gin.Context, info *storage.ObjectInfo) {
+	if info.ETag != "" {
+		c.Header("ETag", quoteETag(info.ETag))
+	}
+	if !info.ModTime.IsZero() {
+		c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since for a GET or
+// HEAD request. If-None-Match takes precedence as required by RFC 7232.
+func notModified(c *gin.Context, info *storage.ObjectInfo) bool {
+	if header := c.GetHeader("If-None-Match"); header != "" {
+		return etagListMatches(header, info.ETag, false)
+	}
+
+	if header := c.GetHeader("If-Modified-Since"); header != "" && !info.ModTime.IsZero() {
+		since, err := http.ParseTime(header)
+		if err != nil {
+			return false
+		}
+		return !info.ModTime.Truncate(time.Second).After(since)
+	}
+
+	return false
+}
+
+// ifRangeMatches reports whether a Range header should be honoured given the
+// If-Range header. A stale validator means the full file must be sent.
+func ifRangeMatches(c *gin.Context, info *storage.ObjectInfo) bool {
+	header := strings.TrimSpace(c.GetHeader("If-Range"))
+	if header == "" {
+		return true
+	}
+
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return etagMatches(header, info.ETag, true)
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil || info.ModTime.IsZero() {
+		return false
+	}
+	return info.ModTime.Truncate(time.Second).Equal(date)
+}
+
+// writeConditions turns If-Match and If-None-Match request headers into
+// conditions for a PUT or DELETE. Weak tags never match in If-Match since it
+// requires strong comparison.
+func writeConditions(c *gin.Context) storage.Conditions {
+	return storage.Conditions{
+		IfMatch:     parseETagList(c.GetHeader("If-Match"), true),
+		IfNoneMatch: parseETagList(c.GetHeader("If-None-Match"), false),
+	}
+}
+
+// parseETagList splits an entity tag list into unquoted tags
+func parseETagList(header string, strong bool) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				// Keep a placeholder so the condition still fails
+				tags = append(tags, tag)
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag != "*" {
+			tag = strings.Trim(tag, `"`)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// etagListMatches reports whether a comma separated list of entity tags, or
+// "*", matches etag
+func etagListMatches(header, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if etagMatches(candidate, etag, strong) {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatches compares a single entity tag from a request with etag. Strong
+// comparison never matches weak tags.
+func etagMatches(candidate, etag string, strong bool) bool {
+	candidate = strings.TrimSpace(candidate)
+	if strings.HasPrefix(candidate, "W/") {
+		if strong {
+			return false
+		}
+		candidate = candidate[2:]
+	}
+	return etag != "" && candidate == quoteETag(etag)
+}
+
+// quoteETag formats an entity tag for use in headers
+func quoteETag(etag string) string {
+	return `"` + etag + `"`
+}
@@ -0,0 +1,31 @@
+package file
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseETagList(t *testing.T) {
+	tests := []struct {
+		header string
+		strong bool
+		want   []string
+	}{
+		{"", true, nil},
+		{`"abc"`, true, []string{"abc"}},
+		{`"abc", "def"`, true, []string{"abc", "def"}},
+		{"*", true, []string{"*"}},
+		{"*", false, []string{"*"}},
+		{`W/"abc"`, false, []string{"abc"}},
+		// Weak tags stay as a placeholder that never matches an ETag
+		{`W/"abc"`, true, []string{`W/"abc"`}},
+		{`W/"abc", "def"`, true, []string{`W/"abc"`, "def"}},
+		{` "abc" ,, `, false, []string{"abc"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseETagList(tt.header, tt.strong); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseETagList(%q, %v) = %q, want %q", tt.header, tt.strong, got, tt.want)
+		}
+	}
+}
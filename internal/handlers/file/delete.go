@@ -1,101 +1,54 @@
 package file
 
 import (
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"path"
 
 	"goviesdeze/internal/config"
+	"goviesdeze/internal/storage"
 	"goviesdeze/internal/utils"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
-// DeleteFile handles file deletion for both local filesystem and S3
-func DeleteFile(cfg *config.Config) gin.HandlerFunc {
+// DeleteFile handles file deletion
+func DeleteFile(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		filename := c.Param("filename")
-		basePath := utils.ShardPath(filename, cfg.StoragePath)
 
-		// Generate candidate paths for the file
-		candidates := utils.GenerateCandidatePaths(basePath)
-
-		if cfg.S3 {
-			// S3 deletion logic
-			key := candidates[0] // Use the first candidate as S3 object key
-
-			// Check if file exists and get its size
-			headInput := &s3.HeadObjectInput{
-				Bucket: aws.String(cfg.S3Bucket),
-				Key:    aws.String(key),
-			}
-
-			var size int64
-			headOutput, err := cfg.S3Client.HeadObject(headInput)
-			if err != nil {
-				if strings.Contains(err.Error(), "NotFound") {
-					c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-					return
-				}
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
-				return
-			}
-			size = aws.Int64Value(headOutput.ContentLength)
-
-			// Delete the object
-			deleteInput := &s3.DeleteObjectInput{
-				Bucket: aws.String(cfg.S3Bucket),
-				Key:    aws.String(key),
-			}
-
-			if _, err := cfg.S3Client.DeleteObject(deleteInput); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file from S3"})
+		info, err := resolveFile(c.Request.Context(), store, filename)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 				return
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
+			return
+		}
 
-			// Update usage
-			utils.SetUsage(utils.GetUsage() - size)
-
-			c.JSON(http.StatusOK, gin.H{
-				"deleted":    filepath.Base(key),
-				"sizeFreed":  size,
-			})
-		} else {
-			// Local filesystem deletion logic
-			var filePath string
-			var fileInfo os.FileInfo
-
-			// Check each candidate path for existence
-			for _, candidate := range candidates {
-				if info, err := os.Stat(candidate); err == nil {
-					filePath = candidate
-					fileInfo = info
-					break
-				}
-			}
-
-			// If no file found, return 404
-			if filePath == "" {
+		// Delete the file
+		removed, err := store.Delete(c.Request.Context(), info.Key, writeConditions(c))
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
 				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 				return
 			}
-
-			// Delete the file
-			if err := os.Remove(filePath); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+			if errors.Is(err, storage.ErrPreconditionFailed) {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Precondition failed"})
 				return
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
+			return
+		}
 
-			// Update usage
-			utils.SetUsage(utils.GetUsage() - fileInfo.Size())
+		// Update usage with the version actually removed, it may have been
+		// replaced since the lookup above
+		utils.RemoveFile(removed.Usage())
 
-			c.JSON(http.StatusOK, gin.H{
-				"deleted":    filepath.Base(filePath),
-				"sizeFreed":  fileInfo.Size(),
-			})
-		}
+		c.JSON(http.StatusOK, gin.H{
+			"deleted":   path.Base(removed.Key),
+			"sizeFreed": removed.Size,
+		})
 	}
 }
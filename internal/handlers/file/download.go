@@ -1,215 +1,200 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"path"
 	"strconv"
-	"strings"
 
 	"goviesdeze/internal/config"
-	"goviesdeze/internal/utils"
+	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/storage"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
-	"github.com/h2non/filetype"
 )
 
-// GetFile handles file downloads with range request support for both local filesystem and S3
-func GetFile(cfg *config.Config) gin.HandlerFunc {
+// maxServeAttempts caps how often a download starts over because the file
+// was replaced between checking and opening it
+const maxServeAttempts = 3
+
+// errFileChanged is returned when the opened version of a file is not the
+// one the response headers and range decisions were based on
+var errFileChanged = errors.New("file changed while opening")
+
+// GetFile handles file downloads with range request support. With
+// S3_REDIRECT the client is redirected to a presigned S3 URL instead.
+func GetFile(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		filename := c.Param("filename")
-		basePath := utils.ShardPath(filename, cfg.StoragePath)
-
-		if cfg.S3 {
-			// S3 download logic
-			// Generate candidate paths and test each one
-			candidates := utils.GenerateCandidatePaths(basePath)
-			var foundKey string
-			var headOutput *s3.HeadObjectOutput
-
-			for _, testKey := range candidates {
-				headInput := &s3.HeadObjectInput{
-					Bucket: aws.String(cfg.S3Bucket),
-					Key:    aws.String(testKey),
-				}
-				if output, err := cfg.S3Client.HeadObject(headInput); err == nil {
-					foundKey = testKey
-					headOutput = output
-					break
-				}
+		for attempt := 1; ; attempt++ {
+			err := serveFile(c, cfg, store)
+			if !errors.Is(err, errFileChanged) {
+				return
 			}
-
-			if foundKey == "" {
-				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			// The validators of the previous version must not leak into the
+			// next attempt
+			c.Writer.Header().Del("ETag")
+			c.Writer.Header().Del("Last-Modified")
+			if attempt == maxServeAttempts {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "File is being replaced"})
 				return
 			}
+		}
+	}
+}
 
-			fileSize := aws.Int64Value(headOutput.ContentLength)
-			contentType := aws.StringValue(headOutput.ContentType)
-			if contentType == "" {
-				contentType = getContentType(foundKey)
-			}
+// serveFile answers a download from the current version of the file. It
+// returns errFileChanged before writing the response when the version opened
+// differs from the one that was checked, so the caller can start over.
+func serveFile(c *gin.Context, cfg *config.Config, store storage.Backend) error {
+	filename := c.Param("filename")
 
-			rangeHeader := c.GetHeader("Range")
-			if rangeHeader != "" {
-				// Handle range request
-				start, end, err := parseRange(rangeHeader, fileSize)
-				if err != nil {
-					c.Header("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
-					c.Status(http.StatusRequestedRangeNotSatisfiable)
-					return
-				}
-
-				getInput := &s3.GetObjectInput{
-					Bucket: aws.String(cfg.S3Bucket),
-					Key:    aws.String(foundKey),
-					Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
-				}
-
-				output, err := cfg.S3Client.GetObject(getInput)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get object from S3"})
-					return
-				}
-				defer output.Body.Close()
-
-				c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-				c.Header("Accept-Ranges", "bytes")
-				c.Header("Content-Length", strconv.FormatInt(end-start+1, 10))
-				c.Header("Content-Type", contentType)
-				c.Status(http.StatusPartialContent)
-
-				io.Copy(c.Writer, output.Body)
-			} else {
-				// Handle full file request
-				getInput := &s3.GetObjectInput{
-					Bucket: aws.String(cfg.S3Bucket),
-					Key:    aws.String(foundKey),
-				}
-
-				output, err := cfg.S3Client.GetObject(getInput)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get object from S3"})
-					return
-				}
-				defer output.Body.Close()
-
-				c.Header("Content-Length", strconv.FormatInt(fileSize, 10))
-				c.Header("Content-Type", contentType)
-				c.Header("Accept-Ranges", "bytes")
-				c.Status(http.StatusOK)
-
-				io.Copy(c.Writer, output.Body)
-			}
-		} else {
-			// Local filesystem download logic
-			candidates := utils.GenerateCandidatePaths(basePath)
-			var filePath string
-			var fileInfo os.FileInfo
-
-			// Find the file
-			for _, candidate := range candidates {
-				if info, err := os.Stat(candidate); err == nil {
-					filePath = candidate
-					fileInfo = info
-					break
-				}
-			}
+	info, err := resolveFile(c.Request.Context(), store, filename)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return nil
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
+		return nil
+	}
 
-			if filePath == "" {
-				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
-				return
-			}
+	fileSize := info.Size
+	contentType := contentTypeOf(info)
+
+	setValidators(c, info)
+	applySignedLink(c)
+	c.Header("X-Resolved-Name", path.Base(info.Key))
+	if notModified(c, info) {
+		c.Status(http.StatusNotModified)
+		return nil
+	}
 
-			fileSize := fileInfo.Size()
-			contentType := getContentType(filePath)
-
-			rangeHeader := c.GetHeader("Range")
-			if rangeHeader != "" {
-				// Handle range request
-				start, end, err := parseRange(rangeHeader, fileSize)
-				if err != nil {
-					c.Header("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
-					c.Status(http.StatusRequestedRangeNotSatisfiable)
-					return
-				}
-
-				file, err := os.Open(filePath)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
-					return
-				}
-				defer file.Close()
-
-				file.Seek(start, 0)
-				limitedReader := io.LimitReader(file, end-start+1)
-
-				c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-				c.Header("Accept-Ranges", "bytes")
-				c.Header("Content-Length", strconv.FormatInt(end-start+1, 10))
-				c.Header("Content-Type", contentType)
-				c.Status(http.StatusPartialContent)
-
-				io.Copy(c.Writer, limitedReader)
-			} else {
-				// Handle full file request
-				file, err := os.Open(filePath)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
-					return
-				}
-				defer file.Close()
-
-				c.Header("Content-Length", strconv.FormatInt(fileSize, 10))
-				c.Header("Content-Type", contentType)
-				c.Header("Accept-Ranges", "bytes")
-				c.Status(http.StatusOK)
-
-				io.Copy(c.Writer, file)
+	// Let S3 serve the bytes unless the client asked to be proxied
+	if cfg.S3Redirect && !proxyRequested(c) {
+		if presigner, ok := store.(storage.Presigner); ok && boundRange(c) == "" {
+			location, err := presigner.PresignGet(c.Request.Context(), info.Key, cfg.S3RedirectTTL, storage.PresignOptions{
+				ContentType:        contentType,
+				ContentDisposition: c.Writer.Header().Get("Content-Disposition"),
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to presign download"})
+				return nil
 			}
+			c.Header("Cache-Control", "private, no-store")
+			c.Redirect(http.StatusFound, location)
+			return nil
 		}
 	}
-}
 
-// parseRange parses the Range header and returns start and end positions
-func parseRange(rangeHeader string, fileSize int64) (int64, int64, error) {
-	rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
-	parts := strings.Split(rangeHeader, "-")
-
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("invalid range format")
+	var ranges []byteRange
+	if rangeHeader := c.GetHeader("Range"); rangeHeader != "" && ifRangeMatches(c, info) {
+		ranges, err = parseRange(rangeHeader, fileSize)
+		// A signed link bound to a range must never serve the full file
+		if err != nil || (ranges == nil && boundRange(c) != "") {
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+			c.Status(http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
 	}
 
-	start, err := strconv.ParseInt(parts[0], 10, 64)
-	if err != nil {
-		return 0, 0, err
+	// The bytes must come from the version checked above
+	ctx := c.Request.Context()
+	openRange := func(r byteRange) (io.ReadCloser, error) {
+		body, opened, err := store.OpenRange(ctx, info.Key, r.start, r.length())
+		if err != nil {
+			return nil, err
+		}
+		if opened.ETag != info.ETag {
+			body.Close()
+			return nil, errFileChanged
+		}
+		return body, nil
 	}
 
-	var end int64
-	if parts[1] == "" {
-		end = fileSize - 1
-	} else {
-		end, err = strconv.ParseInt(parts[1], 10, 64)
+	switch {
+	case len(ranges) == 1:
+		// Handle single range request
+		r := ranges[0]
+		body, err := openRange(r)
 		if err != nil {
-			return 0, 0, err
+			if errors.Is(err, errFileChanged) {
+				return err
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+			return nil
+		}
+		defer body.Close()
+
+		c.Header("Content-Range", r.contentRange(fileSize))
+		c.Header("Accept-Ranges", "bytes")
+		c.Header("Content-Length", strconv.FormatInt(r.length(), 10))
+		c.Header("Content-Type", contentType)
+		c.Status(http.StatusPartialContent)
+
+		io.Copy(c.Writer, body)
+	case len(ranges) > 1:
+		// Handle multiple ranges as multipart/byteranges. The first part is
+		// opened before responding so a replaced file can still start over;
+		// a later mismatch cuts the response short.
+		first, err := openRange(ranges[0])
+		if err != nil {
+			if errors.Is(err, errFileChanged) {
+				return err
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+			return nil
+		}
+		parts := newMultipartRanges(ranges, fileSize, contentType)
+
+		c.Header("Accept-Ranges", "bytes")
+		c.Header("Content-Length", strconv.FormatInt(parts.ContentLength(), 10))
+		c.Header("Content-Type", parts.ContentType())
+		c.Status(http.StatusPartialContent)
+
+		parts.Write(c.Writer, func(r byteRange) (io.ReadCloser, error) {
+			if first != nil {
+				body := first
+				first = nil
+				return body, nil
+			}
+			return openRange(r)
+		})
+	default:
+		// Handle full file request
+		body, opened, err := store.Open(ctx, info.Key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open file"})
+			return nil
+		}
+		defer body.Close()
+		if opened.ETag != info.ETag {
+			return errFileChanged
 		}
-	}
 
-	if start >= fileSize || end >= fileSize || start > end {
-		return 0, 0, fmt.Errorf("invalid range")
+		c.Header("Content-Length", strconv.FormatInt(fileSize, 10))
+		c.Header("Content-Type", contentType)
+		c.Header("Accept-Ranges", "bytes")
+		c.Status(http.StatusOK)
+
+		io.Copy(c.Writer, body)
 	}
+	return nil
+}
 
-	return start, end, nil
+// proxyRequested reports whether the client wants the file served through
+// this service rather than redirected, e.g. because it cannot reach S3
+func proxyRequested(c *gin.Context) bool {
+	proxy, _ := strconv.ParseBool(c.Query("proxy"))
+	return proxy
 }
 
-// getContentType determines the content type based on file extension
-func getContentType(filePath string) string {
-	kind, _ := filetype.MatchFile(filePath)
-	if kind != filetype.Unknown {
-		return kind.MIME.Value
+// boundRange returns the range a signed link restricts the download to. S3
+// cannot enforce it, so such downloads are always proxied.
+func boundRange(c *gin.Context) string {
+	if link := middleware.SignedLink(c); link != nil {
+		return link.Range
 	}
-	return "application/octet-stream"
+	return ""
 }
@@ -1,29 +1,115 @@
 package file
 
 import (
-	"crypto/md5"
-	"fmt"
-	"io"
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"goviesdeze/internal/config"
-	"goviesdeze/internal/utils"
+	"goviesdeze/internal/fetch"
+	"goviesdeze/internal/jobs"
+	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/quota"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
+// FetchOptions are the settings of a single download, shared by the single
+// and batch endpoints
+type FetchOptions struct {
+	URL string `json:"url" binding:"required"`
+	// Method is GET or POST, Body is only sent with POST
+	Method string `json:"method"`
+	Body   string `json:"body"`
+	// Headers and BasicAuth are sent with the request to the remote server
+	Headers   map[string]string `json:"headers"`
+	BasicAuth *fetch.BasicAuth  `json:"basicAuth"`
+	// MaxBytes, Timeout and ConnectTimeout (in seconds) and AllowedTypes
+	// tighten the configured fetch limits for this download
+	MaxBytes       int64    `json:"maxBytes"`
+	Timeout        int64    `json:"timeout"`
+	ConnectTimeout int64    `json:"connectTimeout"`
+	AllowedTypes   []string `json:"allowedTypes"`
+}
+
 // DownloadURLRequest represents the request body for download-url endpoint
 type DownloadURLRequest struct {
-	URL string `json:"url" binding:"required"`
+	FetchOptions
+	// Async queues the download and returns a job to poll instead of waiting
+	Async bool `json:"async"`
+	// CallbackURL receives the final job state, it implies Async
+	CallbackURL string `json:"callbackUrl"`
+}
+
+var (
+	errNegativeLimit = errors.New("maxBytes, timeout and connectTimeout must not be negative")
+	errMethod        = errors.New("method must be GET or POST")
+	errBodyMethod    = errors.New("body is only allowed with POST")
+	errHeader        = errors.New("headers may not set Host, Content-Length, Transfer-Encoding or hop-by-hop headers")
+)
+
+// forbiddenHeaders are controlled by the HTTP client rather than the caller
+var forbiddenHeaders = map[string]bool{
+	"Host":                true,
+	"Content-Length":      true,
+	"Transfer-Encoding":   true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Upgrade":             true,
+}
+
+// request converts the options into a fetch request on behalf of owner
+func (o FetchOptions) request(owner string) (fetch.Request, error) {
+	if o.MaxBytes < 0 || o.Timeout < 0 || o.ConnectTimeout < 0 {
+		return fetch.Request{}, errNegativeLimit
+	}
+
+	method := strings.ToUpper(o.Method)
+	switch method {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		return fetch.Request{}, errMethod
+	}
+	if o.Body != "" && method != http.MethodPost {
+		return fetch.Request{}, errBodyMethod
+	}
+	for name := range o.Headers {
+		if forbiddenHeaders[http.CanonicalHeaderKey(name)] {
+			return fetch.Request{}, errHeader
+		}
+	}
+
+	// Types are compared in lower case, as FETCH_ALLOWED_TYPES is
+	var allowedTypes []string
+	for _, contentType := range o.AllowedTypes {
+		allowedTypes = append(allowedTypes, strings.ToLower(strings.TrimSpace(contentType)))
+	}
+
+	return fetch.Request{
+		URL:       o.URL,
+		Owner:     owner,
+		Method:    method,
+		Body:      o.Body,
+		Headers:   o.Headers,
+		BasicAuth: o.BasicAuth,
+		Limits: fetch.Limits{
+			MaxBytes:       o.MaxBytes,
+			Timeout:        time.Duration(o.Timeout) * time.Second,
+			ConnectTimeout: time.Duration(o.ConnectTimeout) * time.Second,
+			AllowedTypes:   allowedTypes,
+		},
+	}, nil
 }
 
 // DownloadURL handles downloading files from URLs and storing them
-func DownloadURL(cfg *config.Config) gin.HandlerFunc {
+func DownloadURL(cfg *config.Config, fetcher *fetch.Fetcher, downloads *jobs.Manager) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req DownloadURLRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -31,132 +117,95 @@ func DownloadURL(cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
-		// Download the file from URL
-		resp, err := http.Get(req.URL)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch URL"})
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to fetch %s: %s", req.URL, resp.Status)})
-			return
-		}
-
-		if cfg.S3 {
-			// S3 storage logic
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response body"})
+		if req.CallbackURL != "" {
+			if len(cfg.WebhookSecret) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Callbacks are disabled, WEBHOOK_SECRET is not set"})
 				return
 			}
-
-			// Calculate MD5 hash
-			hash := md5.Sum(body)
-			md5sum := fmt.Sprintf("%x", hash)
-			filename := md5sum
-			key := utils.ShardPath(filename, cfg.StoragePath)
-
-			// Check if file already exists
-			headInput := &s3.HeadObjectInput{
-				Bucket: aws.String(cfg.S3Bucket),
-				Key:    aws.String(key),
-			}
-
-			if headOutput, err := cfg.S3Client.HeadObject(headInput); err == nil {
-				// File already exists
-				c.JSON(http.StatusOK, gin.H{
-					"md5":  md5sum,
-					"size": aws.Int64Value(headOutput.ContentLength),
-				})
+			if !validCallbackURL(req.CallbackURL) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "callbackUrl must be an absolute http or https URL"})
 				return
 			}
-
-			// Upload to S3
-			putInput := &s3.PutObjectInput{
-				Bucket:      aws.String(cfg.S3Bucket),
-				Key:         aws.String(key),
-				Body:        aws.ReadSeekCloser(strings.NewReader(string(body))),
-				ContentType: aws.String(resp.Header.Get("Content-Type")),
-			}
-
-			if _, err := cfg.S3Client.PutObject(putInput); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload to S3"})
-				return
-			}
-
-			// Update usage
-			// utils.SetUsage(utils.GetUsage() + int64(len(body)))
-			utils.AddUsage(int64(len(body)))
-
-			c.JSON(http.StatusOK, gin.H{
-				"md5":  md5sum,
-				"size": int64(len(body)),
-			})
-		} else {
-			// Local filesystem storage logic
-			// Create temporary file
-			tmpFile, err := os.CreateTemp(cfg.StoragePath, "tmp_*")
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temporary file"})
+			if err := fetcher.CheckURL(req.CallbackURL); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": "callbackUrl blocked" + strings.TrimPrefix(err.Error(), fetch.ErrBlocked.Error())})
 				return
 			}
-			defer os.Remove(tmpFile.Name())
+		}
 
-			// Calculate MD5 hash while writing
-			hash := md5.New()
-			multiWriter := io.MultiWriter(tmpFile, hash)
+		fetchReq, err := req.request(middleware.KeyName(c))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-			if _, err := io.Copy(multiWriter, resp.Body); err != nil {
-				tmpFile.Close()
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write to temporary file"})
-				return
-			}
-			tmpFile.Close()
-
-			md5sum := fmt.Sprintf("%x", hash.Sum(nil))
-			filename := md5sum
-			finalPath := utils.ShardPath(filename, cfg.StoragePath)
-
-			// Check if file already exists
-			if _, err := os.Stat(finalPath); err == nil {
-				// File already exists, remove temp file
-				os.Remove(tmpFile.Name())
-				if stat, err := os.Stat(finalPath); err == nil {
-					c.JSON(http.StatusOK, gin.H{
-						"md5":  md5sum,
-						"size": stat.Size(),
-					})
+		if async, _ := strconv.ParseBool(c.Query("async")); async || req.Async || req.CallbackURL != "" {
+			job, err := downloads.Submit(fetchReq, req.CallbackURL)
+			if err != nil {
+				if errors.Is(err, jobs.ErrQueueFull) {
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many queued downloads"})
 					return
 				}
-			}
-
-			// Create directory if it doesn't exist
-			if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
-				os.Remove(tmpFile.Name())
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue download"})
 				return
 			}
 
-			// Move temp file to final location
-			if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
-				os.Remove(tmpFile.Name())
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move file"})
-				return
-			}
+			c.Header("Location", "/jobs/"+job.ID)
+			c.JSON(http.StatusAccepted, job)
+			return
+		}
 
-			// Update usage
-			if stat, err := os.Stat(finalPath); err == nil {
-				// utils.SetUsage(utils.GetUsage() + stat.Size())
-				utils.AddUsage(stat.Size())
-				c.JSON(http.StatusOK, gin.H{
-					"md5":  md5sum,
-					"size": stat.Size(),
-				})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get file stats"})
-			}
+		result, err := fetcher.Fetch(c.Request.Context(), fetchReq, nil)
+		if err != nil {
+			c.JSON(fetchErrorStatus(err), gin.H{"error": fetchErrorMessage(err)})
+			return
 		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"md5":  result.MD5,
+			"size": result.Size,
+		})
 	}
 }
+
+// fetchErrorStatus maps fetch errors to response codes
+func fetchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, fetch.ErrBlocked):
+		return http.StatusForbidden
+	case errors.Is(err, fetch.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, fetch.ErrTypeNotAllowed):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, fetch.ErrTimeout):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// fetchErrorMessage returns the message reported to clients for a fetch error
+func fetchErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		return "Storage quota exceeded"
+	case errors.Is(err, fetch.ErrBlocked):
+		return "URL blocked" + strings.TrimPrefix(err.Error(), fetch.ErrBlocked.Error())
+	case errors.Is(err, fetch.ErrTooLarge):
+		return "File too large" + strings.TrimPrefix(err.Error(), fetch.ErrTooLarge.Error())
+	case errors.Is(err, fetch.ErrTypeNotAllowed):
+		return "Content type not allowed" + strings.TrimPrefix(err.Error(), fetch.ErrTypeNotAllowed.Error())
+	case errors.Is(err, fetch.ErrTimeout):
+		return "Fetch timed out" + strings.TrimPrefix(err.Error(), fetch.ErrTimeout.Error())
+	case errors.Is(err, fetch.ErrFetchFailed):
+		return "Failed to fetch URL" + strings.TrimPrefix(err.Error(), fetch.ErrFetchFailed.Error())
+	default:
+		return "Failed to store file"
+	}
+}
+
+// validCallbackURL reports whether a callback can be posted to rawURL
+func validCallbackURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
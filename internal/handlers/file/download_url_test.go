@@ -0,0 +1,36 @@
+package file
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFetchOptionsRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  FetchOptions
+		types []string
+		err   error
+	}{
+		{"defaults", FetchOptions{}, nil, nil},
+		{"types lowercased", FetchOptions{AllowedTypes: []string{"application/PDF", " Image/* "}}, []string{"application/pdf", "image/*"}, nil},
+		{"post with body", FetchOptions{Method: "post", Body: "id=1"}, nil, nil},
+		{"negative limit", FetchOptions{MaxBytes: -1}, nil, errNegativeLimit},
+		{"unsupported method", FetchOptions{Method: "PUT"}, nil, errMethod},
+		{"body without post", FetchOptions{Body: "id=1"}, nil, errBodyMethod},
+		{"forbidden header", FetchOptions{Headers: map[string]string{"host": "example.com"}}, nil, errHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := tt.opts.request("alice")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("request() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && !reflect.DeepEqual(req.Limits.AllowedTypes, tt.types) {
+				t.Errorf("AllowedTypes = %q, want %q", req.Limits.AllowedTypes, tt.types)
+			}
+		})
+	}
+}
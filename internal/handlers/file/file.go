@@ -0,0 +1,31 @@
+package file
+
+import (
+	"context"
+	"errors"
+
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+)
+
+// resolveFile returns the first candidate key for filename that exists in the backend
+func resolveFile(ctx context.Context, store storage.Backend, filename string) (*storage.ObjectInfo, error) {
+	for _, key := range utils.GenerateCandidatePaths(utils.ShardKey(filename)) {
+		info, err := store.Stat(ctx, key)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+	}
+	return nil, storage.ErrNotFound
+}
+
+// contentTypeOf returns the content type recorded for an object
+func contentTypeOf(info *storage.ObjectInfo) string {
+	if info.ContentType != "" {
+		return info.ContentType
+	}
+	return "application/octet-stream"
+}
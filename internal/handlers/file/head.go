@@ -0,0 +1,43 @@
+package file
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeadFile returns the metadata of a file without its contents
+func HeadFile(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := c.Param("filename")
+
+		info, err := resolveFile(c.Request.Context(), store, filename)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.Status(http.StatusNotFound)
+				return
+			}
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		setValidators(c, info)
+		applySignedLink(c)
+		c.Header("X-Resolved-Name", path.Base(info.Key))
+		if notModified(c, info) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+		c.Header("Content-Type", contentTypeOf(info))
+		c.Header("Accept-Ranges", "bytes")
+		c.Status(http.StatusOK)
+	}
+}
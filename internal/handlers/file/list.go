@@ -0,0 +1,105 @@
+package file
+
+import (
+	"encoding/base64"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListFiles lists stored files in name order with an opaque continuation cursor
+func ListFiles(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prefix := c.Query("prefix")
+
+		limit := defaultListLimit
+		if value := c.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			limit = min(parsed, maxListLimit)
+		}
+
+		startAfter, err := decodeCursor(c.Query("cursor"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+
+		// Names shorter than a shard can live in any shard starting with them
+		keyPrefix := prefix
+		if len(prefix) >= 2 {
+			keyPrefix = utils.ShardKey(prefix)
+		}
+
+		files := []gin.H{}
+		var lastKey string
+		hasMore := false
+		// On S3 content types cost a HEAD request per listed file
+		opts := storage.ListOptions{Prefix: keyPrefix, StartAfter: startAfter, Metadata: true}
+		err = store.List(c.Request.Context(), opts, func(info *storage.ObjectInfo) error {
+			name := path.Base(info.Key)
+			if !strings.HasPrefix(name, prefix) {
+				return nil
+			}
+			if len(files) == limit {
+				hasMore = true
+				return storage.ErrStopList
+			}
+
+			file := gin.H{
+				"name":     name,
+				"size":     info.Size,
+				"modified": info.ModTime.UTC().Format(time.RFC3339),
+			}
+			if info.ContentType != "" {
+				file["contentType"] = info.ContentType
+			}
+			if info.ETag != "" {
+				file["etag"] = info.ETag
+			}
+			files = append(files, file)
+			lastKey = info.Key
+			return nil
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list files"})
+			return
+		}
+
+		response := gin.H{"files": files}
+		if hasMore {
+			response["nextCursor"] = encodeCursor(lastKey)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// encodeCursor hides the storage key a listing stopped at
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeCursor returns the storage key encoded in a cursor
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
@@ -0,0 +1,199 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges caps how many ranges a single request may ask for
+const maxRanges = 64
+
+var errUnsatisfiableRange = errors.New("range not satisfiable")
+
+// byteRange is an inclusive byte range within a file
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange parses a Range header as described in RFC 7233. It supports
+// suffix ranges and multiple ranges, clamps ranges running past the end of the
+// file and drops the ones starting after it. A nil result without an error
+// means the header should be ignored and the full file sent, which is also
+// what RFC 7233 requires for a syntactically invalid header.
+func parseRange(rangeHeader string, fileSize int64) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(strings.TrimSpace(rangeHeader), "bytes=")
+	if !ok {
+		// Unknown range units must be ignored
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	var total int64
+	var valid bool
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last N bytes
+			suffix, ok := parseBytePos(last)
+			if !ok {
+				return nil, nil
+			}
+			valid = true
+			if suffix == 0 || fileSize == 0 {
+				continue
+			}
+			if suffix > fileSize {
+				suffix = fileSize
+			}
+			r = byteRange{start: fileSize - suffix, end: fileSize - 1}
+		} else {
+			start, ok := parseBytePos(first)
+			if !ok {
+				return nil, nil
+			}
+			end := fileSize - 1
+			if last != "" {
+				if end, ok = parseBytePos(last); !ok || end < start {
+					return nil, nil
+				}
+			}
+			valid = true
+			if start >= fileSize {
+				continue
+			}
+			if end >= fileSize {
+				end = fileSize - 1
+			}
+			r = byteRange{start: start, end: end}
+		}
+
+		ranges = append(ranges, r)
+		total += r.length()
+	}
+
+	// A header without any range is invalid rather than unsatisfiable
+	if !valid {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	// Too many or overlapping ranges are cheaper to answer with the full file
+	if len(ranges) > maxRanges || total > fileSize {
+		return nil, nil
+	}
+
+	return ranges, nil
+}
+
+// parseBytePos parses a byte position, which consists of digits only
+func parseBytePos(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// multipartRanges writes the parts of a multipart/byteranges response
+type multipartRanges struct {
+	ranges      []byteRange
+	fileSize    int64
+	contentType string
+	boundary    string
+}
+
+func newMultipartRanges(ranges []byteRange, fileSize int64, contentType string) *multipartRanges {
+	return &multipartRanges{
+		ranges:      ranges,
+		fileSize:    fileSize,
+		contentType: contentType,
+		boundary:    multipart.NewWriter(io.Discard).Boundary(),
+	}
+}
+
+// ContentType returns the value of the response Content-Type header
+func (m *multipartRanges) ContentType() string {
+	return "multipart/byteranges; boundary=" + m.boundary
+}
+
+// ContentLength returns the exact size of the encoded response body
+func (m *multipartRanges) ContentLength() int64 {
+	var counter countingWriter
+	var size int64
+	mw := m.writer(&counter)
+	for _, r := range m.ranges {
+		mw.CreatePart(m.partHeader(r))
+		size += r.length()
+	}
+	mw.Close()
+	return size + int64(counter)
+}
+
+// Write encodes every range into w, opening each with open
+func (m *multipartRanges) Write(w io.Writer, open func(byteRange) (io.ReadCloser, error)) error {
+	mw := m.writer(w)
+	for _, r := range m.ranges {
+		part, err := mw.CreatePart(m.partHeader(r))
+		if err != nil {
+			return err
+		}
+
+		body, err := open(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, body, r.length())
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (m *multipartRanges) writer(w io.Writer) *multipart.Writer {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(m.boundary)
+	return mw
+}
+
+func (m *multipartRanges) partHeader(r byteRange) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Type":  {m.contentType},
+		"Content-Range": {r.contentRange(m.fileSize)},
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,77 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	manyRanges := make([]string, maxRanges+1)
+	for i := range manyRanges {
+		manyRanges[i] = fmt.Sprintf("%d-%d", i, i)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"single", "bytes=0-99", 1000, []byteRange{{0, 99}}, nil},
+		{"whitespace", " bytes= 10 - 19 ", 1000, []byteRange{{10, 19}}, nil},
+		{"open ended", "bytes=900-", 1000, []byteRange{{900, 999}}, nil},
+		{"suffix", "bytes=-100", 1000, []byteRange{{900, 999}}, nil},
+		{"suffix larger than file", "bytes=-5000", 1000, []byteRange{{0, 999}}, nil},
+		{"end clamped", "bytes=500-5000", 1000, []byteRange{{500, 999}}, nil},
+		{"last byte", "bytes=999-999", 1000, []byteRange{{999, 999}}, nil},
+		{"multiple", "bytes=0-9,20-29,-10", 1000, []byteRange{{0, 9}, {20, 29}, {990, 999}}, nil},
+		{"empty specs skipped", "bytes=0-9,,20-29", 1000, []byteRange{{0, 9}, {20, 29}}, nil},
+		{"range past end dropped", "bytes=0-9,2000-2999", 1000, []byteRange{{0, 9}}, nil},
+		{"maximum ranges", "bytes=" + strings.Join(manyRanges[:maxRanges], ","), 1000, parsedRanges(maxRanges), nil},
+
+		// The full file is sent for these
+		{"unknown unit", "items=0-9", 1000, nil, nil},
+		{"missing unit", "0-1023", 1000, nil, nil},
+		{"too many ranges", "bytes=" + strings.Join(manyRanges, ","), 1000, nil, nil},
+		{"overlapping ranges", "bytes=0-799,200-999", 1000, nil, nil},
+		{"end before start", "bytes=10-5", 1000, nil, nil},
+		{"no dash", "bytes=10", 1000, nil, nil},
+		{"negative suffix", "bytes=--5", 1000, nil, nil},
+		{"not a number", "bytes=a-b", 1000, nil, nil},
+		{"signed start", "bytes=+5-10", 1000, nil, nil},
+		{"invalid among valid", "bytes=0-9,abc", 1000, nil, nil},
+		{"invalid past end", "bytes=2000-1000", 1000, nil, nil},
+		{"no specs", "bytes=", 1000, nil, nil},
+
+		{"start past end", "bytes=1000-", 1000, nil, errUnsatisfiableRange},
+		{"all past end", "bytes=1000-1999,5000-", 1000, nil, errUnsatisfiableRange},
+		{"zero suffix", "bytes=-0", 1000, nil, errUnsatisfiableRange},
+		{"empty file", "bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"suffix of empty file", "bytes=-10", 0, nil, errUnsatisfiableRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRange(tt.header, tt.size)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("parseRange(%q, %d) error = %v, want %v", tt.header, tt.size, err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRange(%q, %d) = %v, want %v", tt.header, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// parsedRanges returns the single byte ranges 0-0, 1-1, ... for n ranges
+func parsedRanges(n int) []byteRange {
+	ranges := make([]byteRange, n)
+	for i := range ranges {
+		ranges[i] = byteRange{int64(i), int64(i)}
+	}
+	return ranges
+}
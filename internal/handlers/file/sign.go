@@ -0,0 +1,132 @@
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/signing"
+	"goviesdeze/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSignedURLTTL is how long a signed link is valid when not specified
+const defaultSignedURLTTL = time.Hour
+
+// SignRequest represents the optional request body for the sign endpoint
+type SignRequest struct {
+	// ExpiresIn is the lifetime of the link in seconds
+	ExpiresIn int64 `json:"expiresIn"`
+	// Range limits the link to a byte range, e.g. "bytes=0-1023"
+	Range string `json:"range"`
+	// Filename is sent as the download name in Content-Disposition
+	Filename string `json:"filename"`
+	// IP restricts the link to a single client IP
+	IP string `json:"ip"`
+}
+
+// SignFile creates an expiring link to download a file without an API key
+func SignFile(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := c.Param("filename")
+
+		var req SignRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		ttl := defaultSignedURLTTL
+		if req.ExpiresIn != 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if ttl <= 0 || ttl > cfg.SignedURLMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expiresIn must be between 1 and %d seconds", int64(cfg.SignedURLMaxTTL.Seconds()))})
+			return
+		}
+
+		info, err := resolveFile(c.Request.Context(), store, filename)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
+			return
+		}
+
+		if req.Range != "" {
+			// Ranges that would be ignored in favour of the full file cannot
+			// be bound
+			if ranges, err := parseRange(req.Range, info.Size); err != nil || ranges == nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid range"})
+				return
+			}
+		}
+		if req.IP != "" {
+			ip, ok := signing.CanonicalIP(req.IP)
+			if !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ip"})
+				return
+			}
+			req.IP = ip
+		}
+		if strings.ContainsAny(req.Filename, "/\\\r\n") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+			return
+		}
+
+		link := &signing.Link{
+			Filename:    filename,
+			Expires:     time.Now().Add(ttl),
+			Range:       req.Range,
+			Disposition: req.Filename,
+			IP:          req.IP,
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"url":     baseURL(cfg, c) + "/file/" + url.PathEscape(filename) + "?" + link.Query(cfg.SigningKey).Encode(),
+			"expires": link.Expires.UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// applySignedLink enforces the restrictions of the signed link a request was
+// authorized by. A bound range replaces whatever range the client asked for.
+func applySignedLink(c *gin.Context) {
+	link := middleware.SignedLink(c)
+	if link == nil {
+		return
+	}
+
+	if link.Range != "" {
+		c.Request.Header.Set("Range", link.Range)
+		c.Request.Header.Del("If-Range")
+	}
+	if link.Disposition != "" {
+		if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": link.Disposition}); disposition != "" {
+			c.Header("Content-Disposition", disposition)
+		}
+	}
+}
+
+// baseURL returns the scheme and host clients reach the service at
+func baseURL(cfg *config.Config, c *gin.Context) string {
+	if cfg.PublicURL != "" {
+		return cfg.PublicURL
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
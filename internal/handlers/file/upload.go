@@ -1,108 +1,100 @@
 package file
 
 import (
-	"io"
+	"errors"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
 
 	"goviesdeze/internal/config"
+	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/quota"
+	"goviesdeze/internal/storage"
 	"goviesdeze/internal/utils"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
-// UploadFile handles file uploads for both local filesystem and S3
-func UploadFile(cfg *config.Config) gin.HandlerFunc {
+// UploadFile handles file uploads
+func UploadFile(cfg *config.Config, store storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		filename := c.Param("filename")
-		filePath := utils.ShardPath(filename, cfg.StoragePath)
-		var existingSize int64
-
-		if cfg.S3 {
-			// S3 upload logic
-			key := filePath
-
-			// Check if file exists in S3
-			headInput := &s3.HeadObjectInput{
-				Bucket: aws.String(cfg.S3Bucket),
-				Key:    aws.String(key),
-			}
-			if headOutput, err := cfg.S3Client.HeadObject(headInput); err == nil {
-				existingSize = aws.Int64Value(headOutput.ContentLength)
-			}
-
-			// Read request body
-			body, err := io.ReadAll(c.Request.Body)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
+		key := utils.ShardKey(filename)
+		if !storage.ValidKey(key) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+			return
+		}
+		checksums, err := parseRequestChecksums(c.Request.Header)
+		if err != nil {
+			if errors.Is(err, errConflictingChecksum) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Conflicting checksum headers"})
 				return
 			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid checksum header"})
+			return
+		}
 
-			// Upload to S3
-			putInput := &s3.PutObjectInput{
-				Bucket: aws.String(cfg.S3Bucket),
-				Key:    aws.String(key),
-				Body:   aws.ReadSeekCloser(strings.NewReader(string(body))),
-			}
-			if _, err := cfg.S3Client.PutObject(putInput); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload to S3"})
-				return
-			}
+		// Check if file exists
+		existing, err := store.Stat(c.Request.Context(), key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check file existence"})
+			return
+		}
 
-			byteCount := int64(len(body))
-			totalSize := utils.GetUsage() - existingSize + byteCount
-			// utils.SetUsage(totalSize)
-			utils.AddUsage(-existingSize)
-			utils.AddUsage(byteCount)
+		// Reject bodies that cannot fit before reading them. Without a
+		// Content-Length the quota is enforced while the body streams in.
+		owner := middleware.KeyName(c)
+		var replaced *utils.FileUsage
+		if existing != nil {
+			usage := existing.Usage()
+			replaced = &usage
+		}
+		reservation, err := quota.Reserve(owner, c.Request.ContentLength, replaced)
+		if err != nil {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+			return
+		}
+		defer reservation.Release()
 
-			c.JSON(http.StatusOK, gin.H{
-				"uploaded":  filename,
-				"replaced":  existingSize > 0,
-				"oldSize":   existingSize,
-				"newSize":   byteCount,
-				"totalSize": totalSize,
-			})
-		} else {
-			// Local filesystem upload logic
-			if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create directory"})
+		// Store request body, verifying it before it replaces the old file
+		body := storage.NewChecksumReader(reservation.Reader(c.Request.Body), checksums.md5, checksums.sha256)
+		info, err := store.Put(c.Request.Context(), key, body, storage.PutOptions{
+			Owner:      owner,
+			Conditions: writeConditions(c),
+		})
+		if err != nil {
+			if reservation.Exceeded() {
+				c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
 				return
 			}
-
-			// Check if file exists
-			if stat, err := os.Stat(filePath); err == nil {
-				existingSize = stat.Size()
-			}
-
-			// Create file
-			file, err := os.Create(filePath)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create file"})
+			if body.Mismatch() {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Checksum mismatch"})
 				return
 			}
-			defer file.Close()
-
-			// Copy request body to file
-			byteCount, err := io.Copy(file, c.Request.Body)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write file"})
+			if errors.Is(err, storage.ErrPreconditionFailed) {
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Precondition failed"})
 				return
 			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write file"})
+			return
+		}
 
-			totalSize := utils.GetUsage() - existingSize + byteCount
-			utils.SetUsage(totalSize)
+		// Account against the version Put actually replaced, the one seen
+		// above may have changed in the meantime
+		setValidators(c, info)
+		storage.RecordPut(info)
 
-			c.JSON(http.StatusOK, gin.H{
-				"uploaded":  filename,
-				"replaced":  existingSize > 0,
-				"oldSize":   existingSize,
-				"newSize":   byteCount,
-				"totalSize": totalSize,
-			})
+		var oldSize int64
+		if info.Replaced != nil {
+			oldSize = info.Replaced.Size
 		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"uploaded":  filename,
+			"replaced":  info.Replaced != nil,
+			"oldSize":   oldSize,
+			"newSize":   info.Size,
+			"totalSize": utils.GetUsage(),
+			"md5":       body.MD5(),
+			"sha256":    body.SHA256(),
+		})
 	}
 }
@@ -1,23 +1,80 @@
 package handlers
 
 import (
+	"context"
+	"path/filepath"
+
 	"goviesdeze/internal/config"
+	"goviesdeze/internal/fetch"
 	"goviesdeze/internal/handlers/file"
+	"goviesdeze/internal/handlers/jobs"
 	"goviesdeze/internal/handlers/storage"
+	"goviesdeze/internal/handlers/tus"
+	downloadjobs "goviesdeze/internal/jobs"
+	"goviesdeze/internal/middleware"
+	backend "goviesdeze/internal/storage"
+	"goviesdeze/internal/webhooks"
 
 	"github.com/gin-gonic/gin"
 )
 
-// RegisterRoutes registers all the routes for the application
-func RegisterRoutes(router *gin.Engine, cfg *config.Config) {
+// RegisterRoutes registers all the routes for the application. The returned
+// function stops the background download jobs on shutdown.
+func RegisterRoutes(router *gin.Engine, cfg *config.Config) func(context.Context) error {
+	store := backend.New(cfg)
+
+	// Every route requires a scope of the API key unless authentication is off
+	scope := func(s middleware.Scope) gin.HandlerFunc {
+		if !cfg.RequireAPIKey {
+			return func(c *gin.Context) {}
+		}
+		return middleware.RequireScope(s)
+	}
+	read := router.Group("/", scope(middleware.ScopeRead))
+	write := router.Group("/", scope(middleware.ScopeWrite))
+	remove := router.Group("/", scope(middleware.ScopeDelete))
+	admin := router.Group("/", scope(middleware.ScopeAdmin))
+
+	// Files can be downloaded through a signed link, and without a key at
+	// all in public-read mode
+	downloadScope := scope(middleware.ScopeRead)
+	if cfg.PublicRead {
+		downloadScope = func(c *gin.Context) {}
+	}
+	download := router.Group("/", middleware.SignedURL(cfg.SigningKey, downloadScope))
+
 	// Storage usage endpoint
-	router.GET("/storage-usage", storage.GetStorageUsage)
+	read.GET("/storage-usage", storage.GetStorageUsage)
+	admin.POST("/admin/usage/rescan", storage.RescanUsage(store))
 
 	// File operations
-	router.PUT("/file/:filename", file.UploadFile(cfg))
-	router.GET("/file/:filename", file.GetFile(cfg))
-	router.DELETE("/file/:filename", file.DeleteFile(cfg))
+	read.GET("/files", file.ListFiles(cfg, store))
+	write.PUT("/file/:filename", file.UploadFile(cfg, store))
+	download.GET("/file/:filename", file.GetFile(cfg, store))
+	download.HEAD("/file/:filename", file.HeadFile(cfg, store))
+	remove.DELETE("/file/:filename", file.DeleteFile(cfg, store))
+	read.POST("/file/:filename/sign", file.SignFile(cfg, store))
+
+	// Resumable uploads (tus 1.0)
+	uploads := tus.New(cfg, store)
+	write.OPTIONS("/uploads", uploads.Options)
+	write.POST("/uploads", uploads.Create)
+	write.OPTIONS("/uploads/:id", uploads.Options)
+	write.HEAD("/uploads/:id", uploads.Head)
+	write.PATCH("/uploads/:id", uploads.Patch)
+	write.DELETE("/uploads/:id", uploads.Delete)
+
+	// Download URL endpoint, optionally run as a background job
+	fetcher := fetch.New(cfg, store)
+	// Callbacks are only offered with a secret receivers can verify them with
+	var callbacks downloadjobs.Notifier
+	if len(cfg.WebhookSecret) > 0 {
+		callbacks = webhooks.NewDispatcher(filepath.Join(cfg.StoragePath, ".webhooks"), cfg.WebhookSecret, cfg.WebhookMaxAttempts, fetcher.CallbackClient(cfg.WebhookTimeout))
+	}
+	downloads := downloadjobs.NewManager(fetcher, callbacks, cfg.JobWorkers, cfg.JobQueueSize, cfg.JobRetention)
+	write.POST("/download-url", file.DownloadURL(cfg, fetcher, downloads))
+	write.POST("/download-url/batch", file.DownloadURLBatch(cfg, fetcher))
+	write.GET("/jobs/:id", jobs.GetJob(downloads))
 
-	// Download URL endpoint
-	router.POST("/download-url", file.DownloadURL(cfg))
+	return downloads.Shutdown
 }
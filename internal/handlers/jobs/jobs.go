@@ -0,0 +1,21 @@
+package jobs
+
+import (
+	"net/http"
+
+	"goviesdeze/internal/jobs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetJob returns the state and progress of an asynchronous download
+func GetJob(downloads *jobs.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, ok := downloads.Get(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"net/http"
+
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RescanUsage recomputes the storage usage from the backend contents and
+// replaces the persisted totals
+func RescanUsage(store storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		previousSize := utils.GetUsage()
+		previousCount := utils.GetFileCount()
+
+		usage, err := storage.Scan(c.Request.Context(), store)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan storage"})
+			return
+		}
+
+		if err := utils.ReplaceUsage(usage); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save usage"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"totalSizeBytes":    usage.TotalSize,
+			"fileCount":         usage.FileCount,
+			"previousSizeBytes": previousSize,
+			"previousFileCount": previousCount,
+		})
+	}
+}
@@ -2,16 +2,75 @@ package storage
 
 import (
 	"net/http"
+	"sort"
 
+	"goviesdeze/internal/quota"
 	"goviesdeze/internal/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-// GetStorageUsage returns the current storage usage
+// GetStorageUsage returns the current storage usage, optionally broken down
+// by shard, filename prefix or content type. Configured quotas are reported
+// with a warning flag once usage passes the soft limit.
 func GetStorageUsage(c *gin.Context) {
-	totalSize := utils.GetUsage()
-	c.JSON(http.StatusOK, gin.H{
-		"totalSizeBytes": totalSize,
+	usage := utils.GetUsageData()
+	largestFiles := usage.LargestFiles
+	if largestFiles == nil {
+		largestFiles = []utils.FileUsage{}
+	}
+
+	response := gin.H{
+		"totalSizeBytes": usage.TotalSize,
+		"fileCount":      usage.FileCount,
+		"largestFiles":   largestFiles,
+	}
+	if global := quota.GlobalStatus(); global != nil {
+		response["quota"] = global
+	}
+	if keys := quota.KeyStatuses(); len(keys) > 0 {
+		response["keyQuotas"] = keys
+	}
+
+	switch groupBy := c.Query("groupBy"); groupBy {
+	case "":
+	case "shard":
+		response["groupBy"] = groupBy
+		response["groups"] = usageGroups(usage.Shards)
+	case "prefix":
+		response["groupBy"] = groupBy
+		response["groups"] = usageGroups(usage.Prefixes)
+	case "contentType":
+		response["groupBy"] = groupBy
+		response["groups"] = usageGroups(usage.ContentTypes)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "groupBy must be shard, prefix or contentType"})
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// usageGroups lists groups from the largest to the smallest
+func usageGroups(groups map[string]*utils.UsageGroup) []gin.H {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if groups[names[i]].Size != groups[names[j]].Size {
+			return groups[names[i]].Size > groups[names[j]].Size
+		}
+		return names[i] < names[j]
 	})
+
+	result := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		result = append(result, gin.H{
+			"name":      name,
+			"sizeBytes": groups[name].Size,
+			"fileCount": groups[name].Count,
+		})
+	}
+	return result
 }
@@ -0,0 +1,428 @@
+package tus
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/quota"
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusChecksums  = "md5,sha1,sha256"
+
+	// statusChecksumMismatch is the tus specific status for a failed checksum
+	statusChecksumMismatch = 460
+)
+
+var (
+	errInvalidChecksum     = errors.New("invalid Upload-Checksum header")
+	errUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+)
+
+// Handler implements the tus 1.0 resumable upload protocol. Partial uploads
+// live below STORAGE_PATH and are moved into the sharded layout once complete.
+type Handler struct {
+	cfg     *config.Config
+	store   storage.Backend
+	uploads *uploadStore
+
+	// reservations hold the quota of every unfinished upload so concurrent
+	// uploads cannot together exceed it
+	mu           sync.Mutex
+	reservations map[string]*quota.Reservation
+}
+
+// New creates a tus handler storing finished uploads in store. Uploads
+// without progress for TUS_UPLOAD_EXPIRY are removed.
+func New(cfg *config.Config, store storage.Backend) *Handler {
+	h := &Handler{
+		cfg:          cfg,
+		store:        store,
+		uploads:      newUploadStore(cfg.StoragePath),
+		reservations: map[string]*quota.Reservation{},
+	}
+	if cfg.TusUploadExpiry > 0 {
+		go h.expire()
+	}
+	return h
+}
+
+// Options advertises the supported protocol version and extensions
+func (h *Handler) Options(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	c.Header("Tus-Checksum-Algorithm", tusChecksums)
+	c.Status(http.StatusNoContent)
+}
+
+// Create starts a new upload. The target filename is taken from the
+// "filename" key of Upload-Metadata.
+func (h *Handler) Create(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length header"})
+		return
+	}
+
+	metadata, err := parseMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Metadata header"})
+		return
+	}
+
+	filename := metadata["filename"]
+	if !validFilename(filename) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing or invalid filename in Upload-Metadata"})
+		return
+	}
+
+	// Refuse uploads that cannot fit once complete and hold the space until
+	// the upload finishes or is abandoned
+	owner := middleware.KeyName(c)
+	reservation, err := h.reserve(c, filename, owner, length)
+	if err != nil {
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+		return
+	}
+
+	info, err := h.uploads.create(filename, owner, length, metadata)
+	if err != nil {
+		reservation.Release()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+	h.mu.Lock()
+	h.reservations[info.ID] = reservation
+	h.mu.Unlock()
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+info.ID)
+	h.setExpires(c, time.Now())
+
+	// Empty uploads are complete as soon as they are created
+	if length == 0 {
+		if _, err := h.finish(c, info); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+			return
+		}
+	}
+
+	c.Header("Upload-Offset", "0")
+	c.Status(http.StatusCreated)
+}
+
+// Head reports how many bytes of an upload the server has received
+func (h *Handler) Head(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	info, offset, err := h.uploads.get(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(info.Length, 10))
+	c.Status(http.StatusOK)
+}
+
+// Patch appends a chunk to an upload and finalizes it once all bytes arrived
+func (h *Handler) Patch(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	id := c.Param("id")
+	unlock, ok := h.uploads.lock(id)
+	if !ok {
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is in use by another request"})
+		return
+	}
+	defer unlock()
+
+	info, offset, err := h.uploads.get(id)
+	if err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return
+	}
+
+	clientOffset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset header"})
+		return
+	}
+	if clientOffset != offset {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset %d does not match current offset %d", clientOffset, offset)})
+		return
+	}
+
+	// Reservations do not survive a restart, resumed uploads reserve again
+	h.mu.Lock()
+	_, reserved := h.reservations[id]
+	h.mu.Unlock()
+	if !reserved {
+		reservation, err := h.reserve(c, info.Filename, info.Owner, info.Length)
+		if err != nil {
+			c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+			return
+		}
+		h.mu.Lock()
+		h.reservations[id] = reservation
+		h.mu.Unlock()
+	}
+
+	checksum, expected, err := parseChecksum(c.GetHeader("Upload-Checksum"))
+	if err != nil {
+		if errors.Is(err, errUnsupportedChecksum) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported checksum algorithm"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Checksum header"})
+		return
+	}
+
+	file, err := os.OpenFile(h.uploads.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+	defer file.Close()
+
+	// Read one byte past the remaining length to detect oversized chunks
+	remaining := info.Length - offset
+	var writer io.Writer = file
+	if checksum != nil {
+		writer = io.MultiWriter(file, checksum)
+	}
+	written, copyErr := io.Copy(writer, io.LimitReader(c.Request.Body, remaining+1))
+
+	if written > remaining {
+		file.Truncate(offset)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk exceeds Upload-Length"})
+		return
+	}
+
+	// A chunk with a checksum is all or nothing
+	if checksum != nil {
+		if copyErr != nil {
+			file.Truncate(offset)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write chunk"})
+			return
+		}
+		if string(checksum.Sum(nil)) != string(expected) {
+			file.Truncate(offset)
+			c.JSON(statusChecksumMismatch, gin.H{"error": "Checksum mismatch"})
+			return
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write chunk"})
+		return
+	}
+
+	// Keep whatever arrived before the client went away so it can resume
+	offset += written
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	h.setExpires(c, time.Now())
+	if copyErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read chunk"})
+		return
+	}
+
+	if offset == info.Length {
+		file.Close()
+		if _, err := h.finish(c, info); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store file"})
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Delete terminates an upload and discards the received bytes
+func (h *Handler) Delete(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	id := c.Param("id")
+	unlock, ok := h.uploads.lock(id)
+	if !ok {
+		c.JSON(http.StatusLocked, gin.H{"error": "Upload is in use by another request"})
+		return
+	}
+	defer unlock()
+
+	if _, _, err := h.uploads.get(id); err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load upload"})
+		return
+	}
+
+	h.uploads.remove(id)
+	h.release(id)
+	c.Status(http.StatusNoContent)
+}
+
+// finish moves a complete upload into storage and updates the usage
+func (h *Handler) finish(c *gin.Context, info *uploadInfo) (*storage.ObjectInfo, error) {
+	ctx := c.Request.Context()
+	key := utils.ShardKey(info.Filename)
+
+	stored, err := storage.PutFile(ctx, h.store, key, h.uploads.dataPath(info.ID), storage.PutOptions{
+		ContentType: info.Metadata["filetype"],
+		Owner:       info.Owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.uploads.remove(info.ID)
+
+	storage.RecordPut(stored)
+	h.release(info.ID)
+	return stored, nil
+}
+
+// reserve reserves the quota for an upload of length bytes. The file being
+// replaced is credited since it goes away when the upload finishes.
+func (h *Handler) reserve(c *gin.Context, filename, owner string, length int64) (*quota.Reservation, error) {
+	var replaced *utils.FileUsage
+	if existing, err := h.store.Stat(c.Request.Context(), utils.ShardKey(filename)); err == nil {
+		usage := existing.Usage()
+		replaced = &usage
+	}
+	return quota.Reserve(owner, length, replaced)
+}
+
+// release returns the quota held for an upload
+func (h *Handler) release(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if reservation, ok := h.reservations[id]; ok {
+		reservation.Release()
+		delete(h.reservations, id)
+	}
+}
+
+// setExpires reports when an upload last active at lastActive expires
+func (h *Handler) setExpires(c *gin.Context, lastActive time.Time) {
+	if h.cfg.TusUploadExpiry > 0 {
+		c.Header("Upload-Expires", lastActive.Add(h.cfg.TusUploadExpiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+// expire periodically removes uploads that made no progress within
+// TUS_UPLOAD_EXPIRY, including those left over from a previous run
+func (h *Handler) expire() {
+	interval := min(h.cfg.TusUploadExpiry, time.Hour)
+	for {
+		cutoff := time.Now().Add(-h.cfg.TusUploadExpiry)
+		for _, id := range h.uploads.expired(cutoff) {
+			// Uploads receiving a chunk right now are not abandoned
+			unlock, ok := h.uploads.lock(id)
+			if !ok {
+				continue
+			}
+			// A chunk may have arrived since the listing
+			if !h.uploads.isExpired(id, cutoff) {
+				unlock()
+				continue
+			}
+			h.uploads.remove(id)
+			h.release(id)
+			unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// checkVersion rejects requests for an unsupported protocol version
+func checkVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// parseChecksum parses an Upload-Checksum header into a hash and the
+// expected digest
+func parseChecksum(header string) (hash.Hash, []byte, error) {
+	if header == "" {
+		return nil, nil, nil
+	}
+
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, nil, errInvalidChecksum
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errInvalidChecksum
+	}
+
+	switch parts[0] {
+	case "md5":
+		return md5.New(), expected, nil
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	default:
+		return nil, nil, errUnsupportedChecksum
+	}
+}
+
+// validFilename reports whether name can be stored like a /file/:filename upload
+func validFilename(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && path.Base(name) == name && storage.ValidKey(utils.ShardKey(name))
+}
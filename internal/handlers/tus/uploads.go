@@ -0,0 +1,199 @@
+package tus
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUploadNotFound is returned when an upload ID is unknown
+var errUploadNotFound = errors.New("upload not found")
+
+// uploadInfo is persisted next to every partial upload
+type uploadInfo struct {
+	ID        string            `json:"id"`
+	Filename  string            `json:"filename"`
+	Owner     string            `json:"owner,omitempty"`
+	Length    int64             `json:"length"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// uploadStore keeps partial uploads below a directory in the storage path
+type uploadStore struct {
+	dir   string
+	locks sync.Map
+}
+
+func newUploadStore(storagePath string) *uploadStore {
+	return &uploadStore{dir: filepath.Join(storagePath, ".uploads")}
+}
+
+func (s *uploadStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+func (s *uploadStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// create registers a new empty upload
+func (s *uploadStore) create(filename, owner string, length int64, metadata map[string]string) (*uploadInfo, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &uploadInfo{
+		ID:        id,
+		Filename:  filename,
+		Owner:     owner,
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: time.Now(),
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.dataPath(id), nil, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(s.infoPath(id), data, 0644); err != nil {
+		os.Remove(s.dataPath(id))
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// get loads the upload info and the current offset, which is the number of
+// bytes already persisted in the data file
+func (s *uploadStore) get(id string) (*uploadInfo, int64, error) {
+	if !validID(id) {
+		return nil, 0, errUploadNotFound
+	}
+
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errUploadNotFound
+		}
+		return nil, 0, err
+	}
+
+	var info uploadInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, 0, err
+	}
+
+	stat, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, errUploadNotFound
+		}
+		return nil, 0, err
+	}
+
+	return &info, stat.Size(), nil
+}
+
+// expired returns the uploads whose data was last written before cutoff
+func (s *uploadStore) expired(cutoff time.Time) []string {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		if s.isExpired(id, cutoff) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// isExpired reports whether the data of an upload was last written before
+// cutoff or is missing
+func (s *uploadStore) isExpired(id string, cutoff time.Time) bool {
+	stat, err := os.Stat(s.dataPath(id))
+	return err != nil || stat.ModTime().Before(cutoff)
+}
+
+// remove deletes every file belonging to an upload
+func (s *uploadStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+	s.locks.Delete(id)
+}
+
+// lock acquires the per upload lock, returning false if it is already held
+func (s *uploadStore) lock(id string) (func(), bool) {
+	value, _ := s.locks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// newID returns a random upload identifier
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// validID reports whether id looks like an identifier created by newID
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// parseMetadata decodes the Upload-Metadata header
+func parseMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[parts[0]] = string(value)
+		default:
+			return nil, errors.New("invalid metadata pair")
+		}
+	}
+
+	return metadata, nil
+}
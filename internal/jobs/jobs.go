@@ -0,0 +1,258 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"goviesdeze/internal/fetch"
+)
+
+// ErrQueueFull is returned when no more jobs can be queued
+var ErrQueueFull = errors.New("job queue is full")
+
+// errInterrupted is reported for jobs that never finished because the
+// service stopped
+var errInterrupted = errors.New("interrupted by a service restart")
+
+// Notifier sends the final state of jobs that asked for a callback
+type Notifier interface {
+	// Register records the callback when the job is queued, with the
+	// payload to send if the job is lost to a restart
+	Register(id, callbackURL string, fallback any) error
+	// Deliver sends the final job state
+	Deliver(id string, payload any)
+}
+
+// State is the lifecycle state of a job
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// Job is a snapshot of an asynchronous download
+type Job struct {
+	ID     string `json:"id"`
+	State  State  `json:"state"`
+	URL    string `json:"url"`
+	Method string `json:"method,omitempty"`
+	// Headers sent to the remote server, with credentials redacted
+	Headers         map[string]string `json:"headers,omitempty"`
+	BytesDownloaded int64             `json:"bytesDownloaded"`
+	TotalBytes      int64             `json:"totalBytes"`
+	MD5             string            `json:"md5,omitempty"`
+	Size            int64             `json:"size,omitempty"`
+	ContentType     string            `json:"contentType,omitempty"`
+	Existing        bool              `json:"existing,omitempty"`
+	Error           string            `json:"error,omitempty"`
+	CallbackURL     string            `json:"callbackUrl,omitempty"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	StartedAt       *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// job is the mutable state behind a Job, guarded by the manager lock except
+// for the progress counters
+type job struct {
+	Job
+	request  fetch.Request
+	progress fetch.Progress
+}
+
+// Manager runs fetches on a fixed number of workers and keeps their state
+// for polling until the retention period after they finished
+type Manager struct {
+	fetcher   *fetch.Fetcher
+	notifier  Notifier
+	queue     chan *job
+	retention time.Duration
+
+	// ctx is cancelled on shutdown to stop the workers and running fetches
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// NewManager starts workers that take jobs from a queue of queueSize
+func NewManager(fetcher *fetch.Fetcher, notifier Notifier, workers, queueSize int, retention time.Duration) *Manager {
+	m := &Manager{
+		fetcher:   fetcher,
+		notifier:  notifier,
+		queue:     make(chan *job, queueSize),
+		retention: retention,
+		jobs:      map[string]*job{},
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+	return m
+}
+
+// Shutdown stops the workers, cancelling running fetches, and waits for them
+// to clean up until ctx is done. Jobs still queued are left to the callback
+// fallback registered for them.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Submit queues a fetch and returns the new job. When callbackURL is set the
+// final state of the job is posted to it.
+func (m *Manager) Submit(req fetch.Request, callbackURL string) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	j := &job{
+		Job: Job{
+			ID:          id,
+			State:       StateQueued,
+			URL:         fetch.RedactURL(req.URL),
+			Method:      req.Method,
+			Headers:     fetch.RedactHeaders(req.Headers),
+			TotalBytes:  -1,
+			CallbackURL: callbackURL,
+			CreatedAt:   time.Now(),
+		},
+		request: req,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+
+	if len(m.queue) == cap(m.queue) {
+		return nil, ErrQueueFull
+	}
+	if callbackURL != "" {
+		fallback := j.snapshot()
+		fallback.State = StateFailed
+		fallback.Error = errInterrupted.Error()
+		if err := m.notifier.Register(id, callbackURL, fallback); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only Submit sends and it holds the lock, so the checked space remains
+	m.queue <- j
+	m.jobs[id] = j
+	snapshot := j.snapshot()
+	return &snapshot, nil
+}
+
+// Get returns the current state of a job
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	snapshot := j.snapshot()
+	return &snapshot, true
+}
+
+// work runs queued jobs until the manager shuts down
+func (m *Manager) work() {
+	defer m.workers.Done()
+	for {
+		var j *job
+		select {
+		case <-m.ctx.Done():
+			return
+		case j = <-m.queue:
+		}
+		m.run(j)
+	}
+}
+
+// run fetches a single job and reports its final state
+func (m *Manager) run(j *job) {
+	m.mu.Lock()
+	started := time.Now()
+	j.State = StateRunning
+	j.StartedAt = &started
+	m.mu.Unlock()
+
+	result, err := m.fetcher.Fetch(m.ctx, j.request, &j.progress)
+
+	m.mu.Lock()
+	finished := time.Now()
+	j.FinishedAt = &finished
+	switch {
+	case err != nil && m.ctx.Err() != nil:
+		j.State = StateFailed
+		j.Error = errInterrupted.Error()
+	case err != nil:
+		j.State = StateFailed
+		j.Error = err.Error()
+	default:
+		j.State = StateSucceeded
+		j.MD5 = result.MD5
+		j.Size = result.Size
+		j.ContentType = result.ContentType
+		j.Existing = result.Existing
+	}
+	snapshot := j.snapshot()
+	m.mu.Unlock()
+
+	if j.CallbackURL != "" {
+		m.notifier.Deliver(j.ID, snapshot)
+	}
+}
+
+// prune forgets finished jobs past the retention period. The caller must
+// hold the lock.
+func (m *Manager) prune() {
+	cutoff := time.Now().Add(-m.retention)
+	for id, j := range m.jobs {
+		if j.FinishedAt != nil && j.FinishedAt.Before(cutoff) {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// snapshot copies the job including its current progress. The caller must
+// hold the lock.
+func (j *job) snapshot() Job {
+	snapshot := j.Job
+	if j.State != StateQueued {
+		snapshot.BytesDownloaded = j.progress.Downloaded.Load()
+		snapshot.TotalBytes = j.progress.Total.Load()
+	}
+	return snapshot
+}
+
+// newID returns a random job identifier
+func newID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
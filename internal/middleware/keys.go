@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+
+	"goviesdeze/internal/config"
+)
+
+// Scope is a permission granted to an API key
+type Scope string
+
+const (
+	// ScopeRead allows downloading and listing files and reading usage
+	ScopeRead Scope = "read"
+	// ScopeWrite allows uploading files
+	ScopeWrite Scope = "write"
+	// ScopeDelete allows deleting files
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin allows everything, including maintenance endpoints
+	ScopeAdmin Scope = "admin"
+)
+
+// KeySet holds the API keys accepted by APIKeyAuth
+type KeySet struct {
+	keys []apiKey
+}
+
+type apiKey struct {
+	name string
+	// digest is compared instead of the key so comparisons take the same
+	// time regardless of the key lengths
+	digest [sha256.Size]byte
+	scopes map[Scope]bool
+}
+
+// NewKeySet validates the configured keys
+func NewKeySet(keys []config.APIKey) (*KeySet, error) {
+	set := &KeySet{}
+	names := map[string]bool{}
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" {
+			return nil, fmt.Errorf("API keys need a name and a key")
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("duplicate API key name %q", key.Name)
+		}
+		names[key.Name] = true
+
+		scopes := map[Scope]bool{}
+		for _, scope := range key.Scopes {
+			switch Scope(scope) {
+			case ScopeRead, ScopeWrite, ScopeDelete, ScopeAdmin:
+				scopes[Scope(scope)] = true
+			default:
+				return nil, fmt.Errorf("unknown scope %q for API key %q", scope, key.Name)
+			}
+		}
+
+		set.keys = append(set.keys, apiKey{
+			name:   key.Name,
+			digest: sha256.Sum256([]byte(key.Key)),
+			scopes: scopes,
+		})
+	}
+	return set, nil
+}
+
+// lookup finds the key matching provided. Every key is compared so the time
+// taken does not reveal which one matched.
+func (s *KeySet) lookup(provided string) *apiKey {
+	digest := sha256.Sum256([]byte(provided))
+
+	var found *apiKey
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(digest[:], s.keys[i].digest[:]) == 1 {
+			found = &s.keys[i]
+		}
+	}
+	return found
+}
+
+// allows reports whether the key grants scope
+func (k *apiKey) allows(scope Scope) bool {
+	return k.scopes[ScopeAdmin] || k.scopes[scope]
+}
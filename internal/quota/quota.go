@@ -0,0 +1,185 @@
+package quota
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"goviesdeze/internal/utils"
+)
+
+// ErrQuotaExceeded is returned when a write would exceed a storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Limits configures the enforced quotas. Zero means unlimited.
+type Limits struct {
+	// Global caps the total bytes stored
+	Global int64
+	// Keys caps the bytes stored by each API key, by key name
+	Keys map[string]int64
+	// SoftPercent is the share of a quota after which warnings are reported
+	SoftPercent int
+}
+
+var (
+	mu       sync.Mutex
+	limits   Limits
+	reserved int64
+	// reservedByKey holds the bytes promised to in-flight writes per key
+	reservedByKey = map[string]int64{}
+)
+
+// Configure sets the quotas to enforce
+func Configure(l Limits) {
+	mu.Lock()
+	defer mu.Unlock()
+	limits = l
+}
+
+// Reservation holds bytes for a write in progress so concurrent writes cannot
+// together exceed a quota. Release must be called once the write finished and
+// its usage was recorded.
+type Reservation struct {
+	owner string
+	// credit is the size of the file being replaced, which is freed on success
+	credit    int64
+	keyCredit int64
+	bytes     int64
+	exceeded  bool
+}
+
+// Reserve checks that expected more bytes fit for owner and reserves them.
+// replaced is the file the write will replace, if any. expected may be zero
+// when the size is unknown; the reader returned by Reader then reserves bytes
+// as they arrive.
+func Reserve(owner string, expected int64, replaced *utils.FileUsage) (*Reservation, error) {
+	r := &Reservation{owner: owner}
+	if replaced != nil {
+		r.credit = replaced.Size
+		if replaced.Owner == owner {
+			r.keyCredit = replaced.Size
+		}
+	}
+
+	if err := r.grow(expected); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Exceeded reports whether a read through Reader failed on the quota.
+// Backends may wrap the read error, so callers should check this.
+func (r *Reservation) Exceeded() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return r.exceeded
+}
+
+// Reader wraps r so that reading past the remaining quota fails with
+// ErrQuotaExceeded. Bytes beyond the initial reservation are reserved while
+// they are read.
+func (r *Reservation) Reader(reader io.Reader) io.Reader {
+	return &quotaReader{r: reader, reservation: r, allowance: r.bytes}
+}
+
+// Release returns the reserved bytes
+func (r *Reservation) Release() {
+	mu.Lock()
+	defer mu.Unlock()
+	reserved -= r.bytes
+	reservedByKey[r.owner] -= r.bytes
+	if reservedByKey[r.owner] <= 0 {
+		delete(reservedByKey, r.owner)
+	}
+	r.bytes = 0
+}
+
+// grow reserves n more bytes if they fit within both quotas
+func (r *Reservation) grow(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if limits.Global > 0 && utils.GetUsage()+reserved+n-r.credit > limits.Global {
+		r.exceeded = true
+		return ErrQuotaExceeded
+	}
+	if limit := limits.Keys[r.owner]; r.owner != "" && limit > 0 {
+		if utils.GetOwnerUsage(r.owner)+reservedByKey[r.owner]+n-r.keyCredit > limit {
+			r.exceeded = true
+			return ErrQuotaExceeded
+		}
+	}
+
+	reserved += n
+	reservedByKey[r.owner] += n
+	r.bytes += n
+	return nil
+}
+
+// quotaReader reserves bytes as they are read
+type quotaReader struct {
+	r           io.Reader
+	reservation *Reservation
+	// allowance is how many bytes may be read before reserving more
+	allowance int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if extra := int64(n) - q.allowance; extra > 0 {
+		if growErr := q.reservation.grow(extra); growErr != nil {
+			return 0, growErr
+		}
+		q.allowance = 0
+	} else {
+		q.allowance -= int64(n)
+	}
+	return n, err
+}
+
+// Status describes the usage of one quota
+type Status struct {
+	LimitBytes     int64 `json:"limitBytes"`
+	SoftLimitBytes int64 `json:"softLimitBytes"`
+	UsedBytes      int64 `json:"usedBytes"`
+	// Warning is set once usage passes the soft limit
+	Warning bool `json:"warning"`
+}
+
+// GlobalStatus returns the state of the global quota, or nil if there is none
+func GlobalStatus() *Status {
+	mu.Lock()
+	defer mu.Unlock()
+	return status(limits.Global, utils.GetUsage())
+}
+
+// KeyStatuses returns the state of every API key quota by key name
+func KeyStatuses() map[string]*Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	statuses := map[string]*Status{}
+	for owner, limit := range limits.Keys {
+		if s := status(limit, utils.GetOwnerUsage(owner)); s != nil {
+			statuses[owner] = s
+		}
+	}
+	return statuses
+}
+
+func status(limit, used int64) *Status {
+	if limit <= 0 {
+		return nil
+	}
+	soft := limit * int64(limits.SoftPercent) / 100
+	return &Status{
+		LimitBytes:     limit,
+		SoftLimitBytes: soft,
+		UsedBytes:      used,
+		Warning:        used >= soft,
+	}
+}
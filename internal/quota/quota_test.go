@@ -0,0 +1,178 @@
+package quota
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"goviesdeze/internal/utils"
+)
+
+// setup starts from usage holding files and enforces l
+func setup(t *testing.T, l Limits, files ...utils.FileUsage) {
+	t.Helper()
+	if err := utils.LoadUsage(filepath.Join(t.TempDir(), "usage.json")); err != nil {
+		t.Fatal(err)
+	}
+	data := utils.NewUsageData()
+	for _, file := range files {
+		data.Add(file)
+	}
+	if err := utils.ReplaceUsage(data); err != nil {
+		t.Fatal(err)
+	}
+	Configure(l)
+	t.Cleanup(func() { Configure(Limits{}) })
+}
+
+func TestReserve(t *testing.T) {
+	files := []utils.FileUsage{
+		{Name: "a", Size: 50, Owner: "alice"},
+		{Name: "b", Size: 10, Owner: "bob"},
+	}
+	alice := &files[0]
+	bob := &files[1]
+
+	tests := []struct {
+		name     string
+		limits   Limits
+		owner    string
+		expected int64
+		replaced *utils.FileUsage
+		err      error
+	}{
+		{"unlimited", Limits{}, "alice", 1 << 40, nil, nil},
+		{"fits", Limits{Global: 100}, "alice", 40, nil, nil},
+		{"exceeds", Limits{Global: 100}, "alice", 41, nil, ErrQuotaExceeded},
+		{"unknown length", Limits{Global: 60}, "alice", 0, nil, nil},
+		{"replaced file credited", Limits{Global: 100}, "alice", 90, alice, nil},
+		{"replaced file credit is bounded", Limits{Global: 100}, "alice", 91, alice, ErrQuotaExceeded},
+		{"key fits", Limits{Keys: map[string]int64{"alice": 60}}, "alice", 10, nil, nil},
+		{"key exceeds", Limits{Keys: map[string]int64{"alice": 60}}, "alice", 11, nil, ErrQuotaExceeded},
+		{"other key unlimited", Limits{Keys: map[string]int64{"alice": 60}}, "bob", 100, nil, nil},
+		{"key credited for own file", Limits{Keys: map[string]int64{"alice": 60}}, "alice", 60, alice, nil},
+		{"key not credited for other file", Limits{Keys: map[string]int64{"alice": 60}}, "alice", 20, bob, ErrQuotaExceeded},
+		{"global applies to key", Limits{Global: 100, Keys: map[string]int64{"alice": 1000}}, "alice", 41, nil, ErrQuotaExceeded},
+		{"anonymous ignores key limits", Limits{Keys: map[string]int64{"": 1}}, "", 100, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.limits, files...)
+
+			reservation, err := Reserve(tt.owner, tt.expected, tt.replaced)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Reserve(%q, %d) error = %v, want %v", tt.owner, tt.expected, err, tt.err)
+			}
+			if reservation != nil {
+				reservation.Release()
+			}
+		})
+	}
+}
+
+func TestReserveCountsPendingWrites(t *testing.T) {
+	setup(t, Limits{Global: 100, Keys: map[string]int64{"alice": 50}})
+
+	first, err := Reserve("alice", 40, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Reserve("alice", 20, nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("second key reservation error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if _, err := Reserve("bob", 70, nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("global reservation error = %v, want %v", err, ErrQuotaExceeded)
+	}
+
+	// Released bytes are available again
+	first.Release()
+	second, err := Reserve("alice", 50, nil)
+	if err != nil {
+		t.Fatalf("reservation after release error = %v", err)
+	}
+	second.Release()
+}
+
+func TestReader(t *testing.T) {
+	files := []utils.FileUsage{{Name: "a", Size: 60, Owner: "alice"}}
+
+	tests := []struct {
+		name     string
+		limits   Limits
+		expected int64
+		replaced *utils.FileUsage
+		body     int
+		exceeded bool
+	}{
+		{"known length", Limits{Global: 100}, 40, nil, 40, false},
+		{"unknown length fits", Limits{Global: 100}, 0, nil, 40, false},
+		{"unknown length grows past limit", Limits{Global: 100}, 0, nil, 41, true},
+		{"longer than announced", Limits{Global: 100}, 10, nil, 41, true},
+		{"unknown length replacing a file", Limits{Global: 100}, 0, &files[0], 100, false},
+		{"unknown length past key limit", Limits{Keys: map[string]int64{"alice": 70}}, 0, nil, 11, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, tt.limits, files...)
+
+			reservation, err := Reserve("alice", tt.expected, tt.replaced)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reservation.Release()
+
+			n, err := io.Copy(io.Discard, reservation.Reader(strings.NewReader(strings.Repeat("x", tt.body))))
+			if tt.exceeded {
+				if !errors.Is(err, ErrQuotaExceeded) {
+					t.Errorf("read error = %v, want %v", err, ErrQuotaExceeded)
+				}
+			} else if err != nil || n != int64(tt.body) {
+				t.Errorf("read %d bytes, error = %v, want %d bytes", n, err, tt.body)
+			}
+			if reservation.Exceeded() != tt.exceeded {
+				t.Errorf("Exceeded() = %v, want %v", reservation.Exceeded(), tt.exceeded)
+			}
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		used    int64
+		warning bool
+	}{
+		{"below soft limit", 79, false},
+		{"at soft limit", 80, true},
+		{"over limit", 120, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, Limits{Global: 100, Keys: map[string]int64{"alice": 100, "bob": 0}, SoftPercent: 80},
+				utils.FileUsage{Name: "a", Size: tt.used, Owner: "alice"})
+
+			global := GlobalStatus()
+			if global == nil || global.SoftLimitBytes != 80 || global.UsedBytes != tt.used || global.Warning != tt.warning {
+				t.Errorf("GlobalStatus() = %+v, want soft limit 80, used %d, warning %v", global, tt.used, tt.warning)
+			}
+
+			keys := KeyStatuses()
+			if _, ok := keys["bob"]; ok {
+				t.Error("KeyStatuses() reports a key without a limit")
+			}
+			if s := keys["alice"]; s == nil || s.UsedBytes != tt.used || s.Warning != tt.warning {
+				t.Errorf(`KeyStatuses()["alice"] = %+v, want used %d, warning %v`, s, tt.used, tt.warning)
+			}
+		})
+	}
+
+	setup(t, Limits{})
+	if s := GlobalStatus(); s != nil {
+		t.Errorf("GlobalStatus() = %+v without a quota, want nil", s)
+	}
+}
@@ -0,0 +1,113 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned for links that were not signed with the
+	// secret or whose parameters were changed
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired is returned for links past their expiry
+	ErrExpired = errors.New("link expired")
+	// ErrWrongIP is returned when a link bound to a client IP is used by another
+	ErrWrongIP = errors.New("link bound to another client IP")
+)
+
+// Link is a signed download link for a file. Every field except Filename and
+// Expires is optional and restricts how the link may be used.
+type Link struct {
+	// Filename is the name the link downloads, as in /file/:filename
+	Filename string
+	Expires  time.Time
+	// Range is a Range header value the download is limited to
+	Range string
+	// Disposition is the filename sent in a Content-Disposition header
+	Disposition string
+	// IP is the only client IP allowed to use the link
+	IP string
+}
+
+// Query returns the query parameters carrying the link and its signature
+func (l *Link) Query(secret []byte) url.Values {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(l.Expires.Unix(), 10))
+	if l.Range != "" {
+		query.Set("range", l.Range)
+	}
+	if l.Disposition != "" {
+		query.Set("filename", l.Disposition)
+	}
+	if l.IP != "" {
+		query.Set("ip", l.IP)
+	}
+	query.Set("signature", base64.RawURLEncoding.EncodeToString(l.sign(secret)))
+	return query
+}
+
+// Verify checks the signature in query for a download of filename by clientIP
+// and returns the link it describes
+func Verify(secret []byte, filename string, query url.Values, clientIP string, now time.Time) (*Link, error) {
+	signature, err := base64.RawURLEncoding.DecodeString(query.Get("signature"))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	link := &Link{
+		Filename:    filename,
+		Expires:     time.Unix(expires, 0),
+		Range:       query.Get("range"),
+		Disposition: query.Get("filename"),
+		IP:          query.Get("ip"),
+	}
+	if !hmac.Equal(signature, link.sign(secret)) {
+		return nil, ErrInvalidSignature
+	}
+	if !now.Before(link.Expires) {
+		return nil, ErrExpired
+	}
+	if link.IP != "" {
+		ip, ok := CanonicalIP(link.IP)
+		if client, _ := CanonicalIP(clientIP); !ok || ip != client {
+			return nil, ErrWrongIP
+		}
+	}
+	return link, nil
+}
+
+// CanonicalIP returns the canonical text form of an IP address, with
+// IPv4-mapped IPv6 addresses written as IPv4, so equal addresses compare equal
+func CanonicalIP(s string) (string, bool) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
+
+// sign computes the HMAC over every field of the link. Fields are quoted so
+// no value can shift the boundary to another field.
+func (l *Link) sign(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	for _, field := range []string{
+		l.Filename,
+		strconv.FormatInt(l.Expires.Unix(), 10),
+		l.Range,
+		l.Disposition,
+		l.IP,
+	} {
+		mac.Write([]byte(strconv.Quote(field)))
+	}
+	return mac.Sum(nil)
+}
@@ -0,0 +1,147 @@
+package signing
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	secret = []byte("test secret")
+	now    = time.Unix(1700000000, 0)
+)
+
+func TestVerify(t *testing.T) {
+	link := &Link{
+		Filename:    "report.pdf",
+		Expires:     now.Add(time.Hour),
+		Range:       "bytes=0-1023",
+		Disposition: "Quarterly report.pdf",
+		IP:          "203.0.113.7",
+	}
+
+	tests := []struct {
+		name     string
+		filename string
+		query    func(url.Values)
+		secret   []byte
+		clientIP string
+		now      time.Time
+		err      error
+	}{
+		{name: "valid"},
+		{name: "other file", filename: "other.pdf", err: ErrInvalidSignature},
+		{name: "wrong secret", secret: []byte("other secret"), err: ErrInvalidSignature},
+		{name: "extended expiry", query: set("expires", strconv.FormatInt(now.Add(48*time.Hour).Unix(), 10)), err: ErrInvalidSignature},
+		{name: "changed range", query: set("range", "bytes=0-"), err: ErrInvalidSignature},
+		{name: "removed range", query: del("range"), err: ErrInvalidSignature},
+		{name: "changed filename", query: set("filename", "evil.html"), err: ErrInvalidSignature},
+		{name: "removed ip", query: del("ip"), err: ErrInvalidSignature},
+		{name: "changed ip", query: set("ip", "198.51.100.1"), clientIP: "198.51.100.1", err: ErrInvalidSignature},
+		{name: "missing signature", query: del("signature"), err: ErrInvalidSignature},
+		{name: "malformed signature", query: set("signature", "not base64!"), err: ErrInvalidSignature},
+		{name: "truncated signature", query: func(q url.Values) { q.Set("signature", q.Get("signature")[:10]) }, err: ErrInvalidSignature},
+		{name: "malformed expiry", query: set("expires", "soon"), err: ErrInvalidSignature},
+		{name: "expired", now: now.Add(2 * time.Hour), err: ErrExpired},
+		{name: "expires exactly now", now: now.Add(time.Hour), err: ErrExpired},
+		{name: "wrong ip", clientIP: "198.51.100.1", err: ErrWrongIP},
+		{name: "ipv4-mapped client ip", clientIP: "::ffff:203.0.113.7"},
+		{name: "malformed client ip", clientIP: "not an ip", err: ErrWrongIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := link.Query(secret)
+			if tt.query != nil {
+				tt.query(query)
+			}
+			filename := or(tt.filename, link.Filename)
+			key := secret
+			if tt.secret != nil {
+				key = tt.secret
+			}
+			verifyAt := now
+			if !tt.now.IsZero() {
+				verifyAt = tt.now
+			}
+
+			got, err := Verify(key, filename, query, or(tt.clientIP, link.IP), verifyAt)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && *got != *link {
+				t.Errorf("Verify() = %+v, want %+v", got, link)
+			}
+		})
+	}
+}
+
+func TestVerifyUnboundLink(t *testing.T) {
+	link := &Link{Filename: "a.txt", Expires: now.Add(time.Minute)}
+	query := link.Query(secret)
+
+	for _, param := range []string{"range", "filename", "ip"} {
+		if query.Has(param) {
+			t.Errorf("query has %s for a link without it", param)
+		}
+	}
+	if _, err := Verify(secret, "a.txt", query, "198.51.100.1", now); err != nil {
+		t.Errorf("Verify() error = %v, want nil for any client IP", err)
+	}
+
+	// Restrictions cannot be added to a link that had none
+	query.Set("range", "bytes=0-0")
+	if _, err := Verify(secret, "a.txt", query, "198.51.100.1", now); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+		ok   bool
+	}{
+		{"203.0.113.7", "203.0.113.7", true},
+		{"::ffff:203.0.113.7", "203.0.113.7", true},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1", true},
+		{"2001:db8::0001", "2001:db8::1", true},
+		{"", "", false},
+		{"203.0.113", "", false},
+		{"example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := CanonicalIP(tt.ip)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("CanonicalIP(%q) = %q, %v, want %q, %v", tt.ip, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestSignFieldBoundaries checks that moving characters between adjacent
+// fields changes the signature
+func TestSignFieldBoundaries(t *testing.T) {
+	a := &Link{Filename: "a", Expires: now, Range: "bytes=0-1", Disposition: "x"}
+	b := &Link{Filename: "a", Expires: now, Range: "bytes=0-", Disposition: "1x"}
+	if a.Query(secret).Get("signature") == b.Query(secret).Get("signature") {
+		t.Error("links with shifted field boundaries have the same signature")
+	}
+}
+
+func set(name, value string) func(url.Values) {
+	return func(q url.Values) { q.Set(name, value) }
+}
+
+func del(name string) func(url.Values) {
+	return func(q url.Values) { q.Del(name) }
+}
+
+func or(value, fallback string) string {
+	if value != "" {
+		return value
+	}
+	return fallback
+}
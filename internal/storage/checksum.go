@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned when the data read does not match the
+// digest supplied by the client
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumReader hashes everything read through it. When expected digests are
+// set it fails the final read with ErrChecksumMismatch instead of io.EOF, so
+// backends abort the write before the object becomes visible.
+type ChecksumReader struct {
+	r              io.Reader
+	md5            hash.Hash
+	sha256         hash.Hash
+	expectedMD5    []byte
+	expectedSHA256 []byte
+	mismatch       bool
+}
+
+// NewChecksumReader wraps r, verifying the raw digests that are not nil
+func NewChecksumReader(r io.Reader, expectedMD5, expectedSHA256 []byte) *ChecksumReader {
+	return &ChecksumReader{
+		r:              r,
+		md5:            md5.New(),
+		sha256:         sha256.New(),
+		expectedMD5:    expectedMD5,
+		expectedSHA256: expectedSHA256,
+	}
+}
+
+// Read implements io.Reader
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.md5.Write(p[:n])
+	c.sha256.Write(p[:n])
+
+	if err == io.EOF && !c.verify() {
+		c.mismatch = true
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// verify compares the computed digests with the expected ones
+func (c *ChecksumReader) verify() bool {
+	if c.expectedMD5 != nil && !bytes.Equal(c.md5.Sum(nil), c.expectedMD5) {
+		return false
+	}
+	if c.expectedSHA256 != nil && !bytes.Equal(c.sha256.Sum(nil), c.expectedSHA256) {
+		return false
+	}
+	return true
+}
+
+// Mismatch reports whether the data failed verification. Backends may wrap
+// the read error, so callers should check this rather than the error value.
+func (c *ChecksumReader) Mismatch() bool {
+	return c.mismatch
+}
+
+// MD5 returns the hex encoded MD5 of the data read so far
+func (c *ChecksumReader) MD5() string {
+	return hex.EncodeToString(c.md5.Sum(nil))
+}
+
+// SHA256 returns the hex encoded SHA-256 of the data read so far
+func (c *ChecksumReader) SHA256() string {
+	return hex.EncodeToString(c.sha256.Sum(nil))
+}
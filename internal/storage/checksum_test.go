@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestChecksumReader(t *testing.T) {
+	const data = "hello, world"
+	md5Sum := md5.Sum([]byte(data))
+	sha256Sum := sha256.Sum256([]byte(data))
+	otherMD5 := md5.Sum([]byte("other"))
+	otherSHA256 := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name           string
+		expectedMD5    []byte
+		expectedSHA256 []byte
+		mismatch       bool
+	}{
+		{"no digests", nil, nil, false},
+		{"md5", md5Sum[:], nil, false},
+		{"sha256", nil, sha256Sum[:], false},
+		{"both", md5Sum[:], sha256Sum[:], false},
+		{"md5 mismatch", otherMD5[:], nil, true},
+		{"sha256 mismatch", nil, otherSHA256[:], true},
+		{"one of both mismatches", md5Sum[:], otherSHA256[:], true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One byte per read, so the mismatch is only known at EOF
+			r := NewChecksumReader(iotest.OneByteReader(strings.NewReader(data)), tt.expectedMD5, tt.expectedSHA256)
+			got, err := io.ReadAll(r)
+
+			if tt.mismatch {
+				if !errors.Is(err, ErrChecksumMismatch) {
+					t.Errorf("ReadAll() error = %v, want %v", err, ErrChecksumMismatch)
+				}
+			} else if err != nil {
+				t.Errorf("ReadAll() error = %v", err)
+			}
+			if string(got) != data {
+				t.Errorf("ReadAll() = %q, want %q", got, data)
+			}
+			if r.Mismatch() != tt.mismatch {
+				t.Errorf("Mismatch() = %v, want %v", r.Mismatch(), tt.mismatch)
+			}
+			if r.MD5() != "e4d7f1b4ed2e42d15898f4b27b019da4" {
+				t.Errorf("MD5() = %s", r.MD5())
+			}
+			if r.SHA256() != "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b" {
+				t.Errorf("SHA256() = %s", r.SHA256())
+			}
+		})
+	}
+}
+
+func TestChecksumReaderPassesErrors(t *testing.T) {
+	sum := md5.Sum(nil)
+	failure := errors.New("connection reset")
+	r := NewChecksumReader(iotest.ErrReader(failure), sum[:], nil)
+
+	if _, err := io.ReadAll(r); !errors.Is(err, failure) {
+		t.Errorf("ReadAll() error = %v, want %v", err, failure)
+	}
+	if r.Mismatch() {
+		t.Error("Mismatch() = true for an interrupted read")
+	}
+}
@@ -0,0 +1,48 @@
+package storage
+
+import "errors"
+
+// ErrPreconditionFailed is returned when a conditional write does not match
+// the current state of the object
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Conditions makes a write depend on the current version of an object.
+// Entity tags are given without quotes; "*" matches any existing object.
+type Conditions struct {
+	// IfMatch requires the current ETag to be one of these values
+	IfMatch []string
+	// IfNoneMatch requires the current ETag to be none of these values
+	IfNoneMatch []string
+}
+
+// IsZero reports whether no condition is set
+func (c Conditions) IsZero() bool {
+	return len(c.IfMatch) == 0 && len(c.IfNoneMatch) == 0
+}
+
+// Check evaluates the conditions against the current object, which is nil
+// when it does not exist
+func (c Conditions) Check(current *ObjectInfo) error {
+	if len(c.IfMatch) > 0 && (current == nil || !matchesETag(c.IfMatch, current.ETag)) {
+		return ErrPreconditionFailed
+	}
+	if len(c.IfNoneMatch) > 0 && current != nil && matchesETag(c.IfNoneMatch, current.ETag) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// createOnly reports whether the conditions only allow creating a new object
+func (c Conditions) createOnly() bool {
+	return len(c.IfNoneMatch) == 1 && c.IfNoneMatch[0] == "*"
+}
+
+// matchesETag reports whether etag is in tags
+func matchesETag(tags []string, etag string) bool {
+	for _, tag := range tags {
+		if tag == "*" || (etag != "" && tag == etag) {
+			return true
+		}
+	}
+	return false
+}
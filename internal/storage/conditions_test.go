@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConditionsCheck(t *testing.T) {
+	current := &ObjectInfo{Key: "ab/abc", ETag: "v1"}
+
+	tests := []struct {
+		name    string
+		cond    Conditions
+		current *ObjectInfo
+		err     error
+	}{
+		{"none", Conditions{}, current, nil},
+		{"none on missing", Conditions{}, nil, nil},
+		{"if-match current", Conditions{IfMatch: []string{"v1"}}, current, nil},
+		{"if-match one of several", Conditions{IfMatch: []string{"v0", "v1"}}, current, nil},
+		{"if-match stale", Conditions{IfMatch: []string{"v0"}}, current, ErrPreconditionFailed},
+		{"if-match weak placeholder", Conditions{IfMatch: []string{`W/"v1"`}}, current, ErrPreconditionFailed},
+		{"if-match any", Conditions{IfMatch: []string{"*"}}, current, nil},
+		{"if-match any on missing", Conditions{IfMatch: []string{"*"}}, nil, ErrPreconditionFailed},
+		{"if-match on missing", Conditions{IfMatch: []string{"v1"}}, nil, ErrPreconditionFailed},
+		{"if-match against empty etag", Conditions{IfMatch: []string{""}}, &ObjectInfo{}, ErrPreconditionFailed},
+		{"if-none-match any on missing", Conditions{IfNoneMatch: []string{"*"}}, nil, nil},
+		{"if-none-match any on existing", Conditions{IfNoneMatch: []string{"*"}}, current, ErrPreconditionFailed},
+		{"if-none-match current", Conditions{IfNoneMatch: []string{"v1"}}, current, ErrPreconditionFailed},
+		{"if-none-match other", Conditions{IfNoneMatch: []string{"v0"}}, current, nil},
+		{"both hold", Conditions{IfMatch: []string{"v1"}, IfNoneMatch: []string{"v0"}}, current, nil},
+		{"if-none-match fails", Conditions{IfMatch: []string{"v1"}, IfNoneMatch: []string{"v1"}}, current, ErrPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cond.Check(tt.current); !errors.Is(err, tt.err) {
+				t.Errorf("Check() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
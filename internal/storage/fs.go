@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/h2non/filetype"
+)
+
+// FS stores objects as plain files below a root directory
+type FS struct {
+	root  string
+	locks [64]sync.Mutex
+}
+
+// NewFS creates a filesystem backend rooted at root
+func NewFS(root string) *FS {
+	return &FS{root: root}
+}
+
+// path converts a key into a filesystem path below the root. Keys that would
+// leave the root, such as the shard of a name starting with "..", are refused.
+func (f *FS) path(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+// Stat returns metadata for key
+func (f *FS) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return f.objectInfo(key, filePath, info), nil
+}
+
+// Open returns the contents of key
+func (f *FS) Open(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, nil, ErrNotFound
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, nil, ErrNotFound
+	}
+
+	return file, f.objectInfo(key, filePath, info), nil
+}
+
+// OpenRange returns length bytes of key starting at offset
+func (f *FS) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	file, info, err := f.Open(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := file.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return readCloser{Reader: io.LimitReader(file, length), Closer: file}, info, nil
+}
+
+// Put writes r to a temporary file next to the final path and renames it
+// into place once it is complete, so readers never see a partial file and a
+// failed write leaves the previous version untouched
+func (f *FS) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Fail early before reading the body, the check is repeated under the lock
+	if err := f.checkConditions(ctx, key, opts.Conditions); err != nil {
+		return nil, err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, ".tmp_*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hash), r); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return nil, err
+	}
+
+	return f.replace(ctx, key, tmpFile.Name(), hex.EncodeToString(hash.Sum(nil)), opts)
+}
+
+// Import moves the local file at src into place for key
+func (f *FS) Import(ctx context.Context, key, src string, opts PutOptions) (*ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+
+	md5sum := opts.MD5
+	if md5sum == "" {
+		sum, err := hashFile(src)
+		if err != nil {
+			return nil, err
+		}
+		md5sum = sum
+	}
+
+	return f.replace(ctx, key, src, md5sum, opts)
+}
+
+// replace renames src over the file for key once the write conditions hold
+// and records the metadata of the new version. The version it replaces is
+// read under the same lock, so concurrent writers each see the one they
+// actually overwrote.
+func (f *FS) replace(ctx context.Context, key, src, md5sum string, opts PutOptions) (*ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sniff the type once here rather than on every Stat and List
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = sniffType(src)
+	}
+
+	unlock := f.lock(key)
+	defer unlock()
+
+	previous, err := f.Stat(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := opts.Conditions.Check(previous); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(src, filePath); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := fsMeta{
+		MD5:         md5sum,
+		ContentType: contentType,
+		Owner:       opts.Owner,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	}
+	if err := writeMeta(filePath, meta); err != nil {
+		return nil, err
+	}
+	// One sync makes both renames survive a crash
+	syncDir(filepath.Dir(filePath))
+
+	object := f.objectInfo(key, filePath, info)
+	object.Replaced = previous
+	return object, nil
+}
+
+// Delete removes the file for key together with its metadata. The removed
+// version is read under the per-key lock, so it is the one actually deleted.
+func (f *FS) Delete(ctx context.Context, key string, cond Conditions) (*ObjectInfo, error) {
+	filePath, err := f.path(key)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	unlock := f.lock(key)
+	defer unlock()
+
+	current, err := f.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cond.Check(current); err != nil {
+		return nil, err
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	os.Remove(metaPath(filePath))
+	return current, nil
+}
+
+// List walks the storage root and calls fn for every stored file
+func (f *FS) List(ctx context.Context, opts ListOptions, fn func(*ObjectInfo) error) error {
+	// Only descend into the directory holding the prefix when there is one
+	start := f.root
+	if dir := path.Dir(opts.Prefix); dir != "." {
+		var err error
+		if start, err = f.path(dir); err != nil {
+			// Nothing is stored outside the root
+			return nil
+		}
+	}
+
+	err := filepath.WalkDir(start, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath == start {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(f.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if filePath == start {
+				return nil
+			}
+			// Skip hidden directories and shards that cannot contain matches
+			if strings.HasPrefix(d.Name(), ".") || !mayContain(key+"/", opts) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if isInternalFile(key) || !strings.HasPrefix(key, opts.Prefix) || key <= opts.StartAfter {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		return fn(f.objectInfo(key, filePath, info))
+	})
+	if errors.Is(err, ErrStopList) {
+		return nil
+	}
+	return err
+}
+
+// lock serializes writes to a key so conditions can be checked atomically
+func (f *FS) lock(key string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	mu := &f.locks[hash.Sum32()%uint32(len(f.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// checkConditions evaluates write conditions against the current file
+func (f *FS) checkConditions(ctx context.Context, key string, cond Conditions) error {
+	if cond.IsZero() {
+		return nil
+	}
+
+	current, err := f.Stat(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return cond.Check(current)
+}
+
+// objectInfo builds the metadata for a file. The content hash and type come
+// from the metadata file written on upload. Files without valid metadata get
+// an ETag derived from size and mtime and a sniffed type.
+func (f *FS) objectInfo(key, filePath string, info os.FileInfo) *ObjectInfo {
+	object := &ObjectInfo{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		ETag:    fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano()),
+	}
+
+	if meta, ok := readMeta(filePath, info); ok {
+		object.MD5 = meta.MD5
+		object.ETag = meta.MD5
+		object.ContentType = meta.ContentType
+		object.Owner = meta.Owner
+	} else {
+		object.ContentType = sniffType(filePath)
+	}
+
+	return object
+}
+
+// sniffType returns the MIME type detected from the contents of a file, or
+// an empty string if it is not recognised
+func sniffType(filePath string) string {
+	if kind, _ := filetype.MatchFile(filePath); kind != filetype.Unknown {
+		return kind.MIME.Value
+	}
+	return ""
+}
+
+// mayContain reports whether a directory whose keys start with dir can hold
+// keys matching the listing options
+func mayContain(dir string, opts ListOptions) bool {
+	if !strings.HasPrefix(dir, opts.Prefix) && !strings.HasPrefix(opts.Prefix, dir) {
+		return false
+	}
+	if opts.StartAfter != "" && dir < opts.StartAfter && !strings.HasPrefix(opts.StartAfter, dir) {
+		return false
+	}
+	return true
+}
+
+// isInternalFile reports whether a key belongs to the service itself rather
+// than being a stored object, such as temporary files in the storage root
+func isInternalFile(key string) bool {
+	name := path.Base(key)
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	return !strings.Contains(key, "/") && strings.HasPrefix(name, "tmp_")
+}
+
+// syncDir flushes a directory so a rename into it survives a crash
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// readCloser pairs a reader with the closer of its underlying source
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
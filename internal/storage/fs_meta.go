@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fsMeta is stored next to every file written by the filesystem backend.
+// Size and ModTime tie it to one version of the file so that metadata left
+// behind by a crash or a manual copy is ignored.
+type fsMeta struct {
+	MD5         string    `json:"md5"`
+	ContentType string    `json:"contentType,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modTime"`
+}
+
+// metaPath returns the hidden metadata file belonging to filePath
+func metaPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".meta")
+}
+
+// readMeta loads the metadata for filePath if it matches the file on disk
+func readMeta(filePath string, info os.FileInfo) (fsMeta, bool) {
+	var meta fsMeta
+	data, err := os.ReadFile(metaPath(filePath))
+	if err != nil {
+		return meta, false
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, false
+	}
+	if meta.Size != info.Size() || !meta.ModTime.Equal(info.ModTime()) {
+		return meta, false
+	}
+	return meta, true
+}
+
+// writeMeta stores the metadata for filePath. Like the file itself it is
+// written to a temporary file and renamed into place, so readers never see
+// a partial one.
+func writeMeta(filePath string, meta fsMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), ".tmp_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), metaPath(filePath))
+}
+
+// hashFile returns the hex encoded MD5 of a local file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testKey = "ab/abc.txt"
+
+// putString stores s under testKey with cond
+func putString(t *testing.T, fs *FS, s string, cond Conditions) (*ObjectInfo, error) {
+	t.Helper()
+	return fs.Put(context.Background(), testKey, strings.NewReader(s), PutOptions{Conditions: cond})
+}
+
+// readString returns the contents of testKey
+func readString(t *testing.T, fs *FS) string {
+	t.Helper()
+	body, _, err := fs.Open(context.Background(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFSConditionalPut(t *testing.T) {
+	tests := []struct {
+		name string
+		// cond builds the conditions from the ETag of the stored "v1", which
+		// is empty when nothing was stored
+		cond   func(etag string) Conditions
+		exists bool
+		err    error
+	}{
+		{"if-match current", func(etag string) Conditions { return Conditions{IfMatch: []string{etag}} }, true, nil},
+		{"if-match stale", func(string) Conditions { return Conditions{IfMatch: []string{"stale"}} }, true, ErrPreconditionFailed},
+		{"if-match weak", func(etag string) Conditions { return Conditions{IfMatch: []string{`W/"` + etag + `"`}} }, true, ErrPreconditionFailed},
+		{"if-match missing", func(string) Conditions { return Conditions{IfMatch: []string{"*"}} }, false, ErrPreconditionFailed},
+		{"if-none-match any on existing", func(string) Conditions { return Conditions{IfNoneMatch: []string{"*"}} }, true, ErrPreconditionFailed},
+		{"if-none-match any on missing", func(string) Conditions { return Conditions{IfNoneMatch: []string{"*"}} }, false, nil},
+		{"if-none-match current", func(etag string) Conditions { return Conditions{IfNoneMatch: []string{etag}} }, true, ErrPreconditionFailed},
+		{"if-none-match stale", func(string) Conditions { return Conditions{IfNoneMatch: []string{"stale"}} }, true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewFS(t.TempDir())
+			var etag string
+			if tt.exists {
+				info, err := putString(t, fs, "v1", Conditions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				etag = info.ETag
+			}
+
+			info, err := putString(t, fs, "v2", tt.cond(etag))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Put() error = %v, want %v", err, tt.err)
+			}
+
+			switch {
+			case err == nil:
+				if got := readString(t, fs); got != "v2" {
+					t.Errorf("stored %q, want v2", got)
+				}
+				if (info.Replaced != nil) != tt.exists {
+					t.Errorf("Replaced = %+v, want existing %v", info.Replaced, tt.exists)
+				}
+			case tt.exists:
+				if got := readString(t, fs); got != "v1" {
+					t.Errorf("failed write changed the file to %q", got)
+				}
+			default:
+				if _, err := fs.Stat(context.Background(), testKey); !errors.Is(err, ErrNotFound) {
+					t.Errorf("failed write created the file, Stat() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFSConditionalDelete(t *testing.T) {
+	fs := NewFS(t.TempDir())
+	info, err := putString(t, fs, "v1", Conditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Delete(context.Background(), testKey, Conditions{IfMatch: []string{"stale"}}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Delete() with stale If-Match error = %v, want %v", err, ErrPreconditionFailed)
+	}
+	removed, err := fs.Delete(context.Background(), testKey, Conditions{IfMatch: []string{info.ETag}})
+	if err != nil {
+		t.Fatalf("Delete() with current If-Match error = %v", err)
+	}
+	if removed.ETag != info.ETag {
+		t.Errorf("Delete() removed %s, want %s", removed.ETag, info.ETag)
+	}
+	if _, err := fs.Delete(context.Background(), testKey, Conditions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+// TestFSConditionalPutConcurrent checks that conditions are evaluated under
+// the per-key lock, so only one of several racing writers wins
+func TestFSConditionalPutConcurrent(t *testing.T) {
+	const writers = 16
+
+	tests := []struct {
+		name string
+		// setup stores the initial state and returns the writers' conditions
+		setup func(t *testing.T, fs *FS) Conditions
+	}{
+		{"create only", func(*testing.T, *FS) Conditions {
+			return Conditions{IfNoneMatch: []string{"*"}}
+		}},
+		{"compare and swap", func(t *testing.T, fs *FS) Conditions {
+			info, err := putString(t, fs, "v0", Conditions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return Conditions{IfMatch: []string{info.ETag}}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewFS(t.TempDir())
+			cond := tt.setup(t, fs)
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var winners []string
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					content := fmt.Sprintf("writer %d", i)
+					_, err := fs.Put(context.Background(), testKey, strings.NewReader(content), PutOptions{Conditions: cond})
+					if err == nil {
+						mu.Lock()
+						winners = append(winners, content)
+						mu.Unlock()
+					} else if !errors.Is(err, ErrPreconditionFailed) {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if len(winners) != 1 {
+				t.Fatalf("%d writers succeeded, want 1", len(winners))
+			}
+			if got := readString(t, fs); got != winners[0] {
+				t.Errorf("stored %q, want the winner %q", got, winners[0])
+			}
+		})
+	}
+}
+
+func TestFSPutRecordsContentType(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		want        string
+	}{
+		{"sniffed", png, "", "image/png"},
+		{"given", png, "application/x-custom", "application/x-custom"},
+		{"unknown", "plain text", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := NewFS(t.TempDir())
+			info, err := fs.Put(context.Background(), testKey, strings.NewReader(tt.data), PutOptions{ContentType: tt.contentType})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ContentType != tt.want {
+				t.Errorf("Put() content type = %q, want %q", info.ContentType, tt.want)
+			}
+
+			// The type comes from the metadata rather than the contents
+			filePath, _ := fs.path(testKey)
+			stat, err := os.Stat(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			meta, ok := readMeta(filePath, stat)
+			if !ok || meta.ContentType != tt.want {
+				t.Errorf("metadata = %+v, %v, want content type %q", meta, ok, tt.want)
+			}
+		})
+	}
+}
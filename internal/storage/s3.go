@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// ownerMetadata is the user metadata key holding the owning API key name, in
+// the canonical form the SDK returns it in
+const ownerMetadata = "Owner"
+
+// S3 stores objects in an S3 bucket below a key prefix
+type S3 struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// S3UploadOptions tunes multipart uploads. Memory use per upload is bounded
+// by PartSize * Concurrency.
+type S3UploadOptions struct {
+	PartSize    int64
+	Concurrency int
+}
+
+// NewS3 creates an S3 backend. Object keys are prefixed with prefix so that
+// existing buckets laid out by storage path keep working.
+func NewS3(client *s3.S3, bucket, prefix string, opts S3UploadOptions) *S3 {
+	uploader := s3manager.NewUploaderWithClient(client, func(u *s3manager.Uploader) {
+		if opts.PartSize >= s3manager.MinUploadPartSize {
+			u.PartSize = opts.PartSize
+		}
+		if opts.Concurrency > 0 {
+			u.Concurrency = opts.Concurrency
+		}
+	})
+
+	prefix = path.Clean(prefix)
+	if prefix == "." || prefix == "/" {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+	return &S3{client: client, uploader: uploader, bucket: bucket, prefix: prefix}
+}
+
+// objectKey converts a storage key into the S3 object key
+func (s *S3) objectKey(key string) string {
+	return s.prefix + key
+}
+
+// Stat returns metadata for key
+func (s *S3) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	output, err := s.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &ObjectInfo{
+		Key:         key,
+		Size:        aws.Int64Value(output.ContentLength),
+		ModTime:     aws.TimeValue(output.LastModified),
+		ContentType: aws.StringValue(output.ContentType),
+		ETag:        strings.Trim(aws.StringValue(output.ETag), `"`),
+		Owner:       aws.StringValue(output.Metadata[ownerMetadata]),
+	}, nil
+}
+
+// Open returns the contents of key
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+
+	return output.Body, &ObjectInfo{
+		Key:         key,
+		Size:        aws.Int64Value(output.ContentLength),
+		ModTime:     aws.TimeValue(output.LastModified),
+		ContentType: aws.StringValue(output.ContentType),
+		ETag:        strings.Trim(aws.StringValue(output.ETag), `"`),
+		Owner:       aws.StringValue(output.Metadata[ownerMetadata]),
+	}, nil
+}
+
+// OpenRange returns length bytes of key starting at offset
+func (s *S3) OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	output, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, nil, convertError(err)
+	}
+
+	// The object size is the part of Content-Range after the slash
+	contentRange := aws.StringValue(output.ContentRange)
+	size, err := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+	if err != nil {
+		output.Body.Close()
+		return nil, nil, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+
+	return output.Body, &ObjectInfo{
+		Key:         key,
+		Size:        size,
+		ModTime:     aws.TimeValue(output.LastModified),
+		ContentType: aws.StringValue(output.ContentType),
+		ETag:        strings.Trim(aws.StringValue(output.ETag), `"`),
+		Owner:       aws.StringValue(output.Metadata[ownerMetadata]),
+	}, nil
+}
+
+// Put streams r to the object for key using multipart uploads
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (*ObjectInfo, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+
+	hash := md5.New()
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+		Body:   io.TeeReader(r, hash),
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.Owner != "" {
+		input.Metadata = map[string]*string{ownerMetadata: aws.String(opts.Owner)}
+	}
+
+	// Fail early before reading the body, S3 repeats the check atomically.
+	// S3 does not report the version an upload overwrote, so the one seen
+	// here is taken as replaced.
+	previous, err := s.Stat(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err := opts.Conditions.Check(previous); err != nil {
+		return nil, err
+	}
+
+	upload := func(u *s3manager.Uploader) {
+		u.RequestOptions = append(u.RequestOptions, conditionalWrite(opts.Conditions))
+	}
+	if _, err := s.uploader.UploadWithContext(ctx, input, upload); err != nil {
+		return nil, convertError(err)
+	}
+
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info.MD5 = hex.EncodeToString(hash.Sum(nil))
+	info.Replaced = previous
+	return info, nil
+}
+
+// PresignGet returns a URL that downloads key directly from S3 until ttl passes
+func (s *S3) PresignGet(ctx context.Context, key string, ttl time.Duration, opts PresignOptions) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	}
+	if opts.ContentType != "" {
+		input.ResponseContentType = aws.String(opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		input.ResponseContentDisposition = aws.String(opts.ContentDisposition)
+	}
+
+	req, _ := s.client.GetObjectRequest(input)
+	req.SetContext(ctx)
+	return req.Presign(ttl)
+}
+
+// Delete removes the object for key. S3 does not report what it deleted, so
+// the version seen just before is returned.
+func (s *S3) Delete(ctx context.Context, key string, cond Conditions) (*ObjectInfo, error) {
+	// DeleteObject succeeds for missing keys, so check existence first
+	current, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := cond.Check(current); err != nil {
+		return nil, err
+	}
+
+	_, err = s.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.objectKey(key)),
+	}, conditionalWrite(cond))
+	if err != nil {
+		return nil, convertError(err)
+	}
+	return current, nil
+}
+
+// List pages through the bucket and calls fn for every object below the prefix
+func (s *S3) List(ctx context.Context, opts ListOptions, fn func(*ObjectInfo) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.objectKey(opts.Prefix)),
+	}
+	if opts.StartAfter != "" {
+		input.StartAfter = aws.String(s.objectKey(opts.StartAfter))
+	}
+
+	var fnErr error
+	err := s.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			info := &ObjectInfo{
+				Key:     strings.TrimPrefix(aws.StringValue(object.Key), s.prefix),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+				ETag:    strings.Trim(aws.StringValue(object.ETag), `"`),
+			}
+			// Listings carry no content type or user metadata
+			if opts.Metadata {
+				stat, err := s.Stat(ctx, info.Key)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					fnErr = err
+					return false
+				}
+				info.ContentType, info.Owner = stat.ContentType, stat.Owner
+			}
+			if fnErr = fn(info); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if fnErr != nil && fnErr != ErrStopList {
+		return fnErr
+	}
+	return nil
+}
+
+// conditionalWrite sends the conditions as S3 conditional write headers so
+// the check is atomic on the server. Only the requests that make an object
+// visible carry them, and only single values that S3 understands are sent.
+func conditionalWrite(cond Conditions) request.Option {
+	return func(r *request.Request) {
+		switch r.Operation.Name {
+		case "PutObject", "CompleteMultipartUpload", "DeleteObject":
+		default:
+			return
+		}
+
+		if cond.createOnly() && r.Operation.Name != "DeleteObject" {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		}
+		if len(cond.IfMatch) == 1 && cond.IfMatch[0] != "*" {
+			r.HTTPRequest.Header.Set("If-Match", `"`+cond.IfMatch[0]+`"`)
+		}
+	}
+}
+
+// convertError maps S3 error responses to the backend errors
+func convertError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// The upload manager wraps request errors, look at the original one
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.OrigErr() != nil {
+		if _, ok := awsErr.OrigErr().(awserr.RequestFailure); ok {
+			err = awsErr.OrigErr()
+		}
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusNotFound:
+			return ErrNotFound
+		case http.StatusPreconditionFailed, http.StatusConflict:
+			return ErrPreconditionFailed
+		}
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotFound
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrPreconditionFailed
+		}
+	}
+	return err
+}
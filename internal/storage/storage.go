@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"goviesdeze/internal/config"
+)
+
+// ErrNotFound is returned when the requested object does not exist
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is returned for keys that would resolve outside the storage root
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrStopList can be returned from a List callback to stop iteration early
+var ErrStopList = errors.New("stop listing")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// ETag is a strong validator without surrounding quotes
+	ETag string
+	// MD5 is the hex encoded content hash when the backend knows it
+	MD5 string
+	// Owner is the name of the API key that stored the object, if known
+	Owner string
+	// Replaced is the version a Put or Import overwrote, nil when the key
+	// was new. Other methods leave it unset.
+	Replaced *ObjectInfo
+}
+
+// PutOptions holds optional attributes for a stored object
+type PutOptions struct {
+	ContentType string
+	// MD5 is the hex encoded content hash if the caller already computed it
+	MD5 string
+	// Owner is the name of the API key storing the object
+	Owner string
+	// Conditions must hold at the moment the object is replaced
+	Conditions Conditions
+}
+
+// ListOptions restricts which objects List visits
+type ListOptions struct {
+	// Prefix limits the listing to keys starting with this value
+	Prefix string
+	// StartAfter skips every key lexically less than or equal to this value
+	StartAfter string
+	// Metadata fills in ContentType and Owner even where the backend has to
+	// look up each object separately
+	Metadata bool
+}
+
+// Backend is implemented by every storage location. Keys are slash separated
+// paths relative to the storage root, as produced by utils.ShardKey.
+type Backend interface {
+	// Stat returns metadata for key or ErrNotFound
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// Open returns the full contents of key together with its metadata
+	Open(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// OpenRange returns length bytes of key starting at offset together with
+	// the metadata of the version they are read from
+	OpenRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, *ObjectInfo, error)
+	// Put stores everything read from r under key, replacing any existing
+	// object, which is reported in Replaced. It returns
+	// ErrPreconditionFailed when opts.Conditions do not hold.
+	Put(ctx context.Context, key string, r io.Reader, opts PutOptions) (*ObjectInfo, error)
+	// Delete removes key and returns the version it removed, or ErrNotFound.
+	// It returns ErrPreconditionFailed when cond does not hold.
+	Delete(ctx context.Context, key string, cond Conditions) (*ObjectInfo, error)
+	// List calls fn for every object in lexical key order
+	List(ctx context.Context, opts ListOptions, fn func(*ObjectInfo) error) error
+}
+
+// Importer is implemented by backends that can take ownership of a local file
+// without copying it. The file at path is consumed on success.
+type Importer interface {
+	Import(ctx context.Context, key, path string, opts PutOptions) (*ObjectInfo, error)
+}
+
+// PresignOptions sets response headers the presigned download is served with
+type PresignOptions struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// Presigner is implemented by backends that can hand out URLs for clients to
+// download an object directly
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, ttl time.Duration, opts PresignOptions) (string, error)
+}
+
+// ValidKey reports whether key names an entry below the storage root. The
+// root itself, as named by ".", is not a valid key.
+func ValidKey(key string) bool {
+	key = filepath.FromSlash(key)
+	return filepath.IsLocal(key) && filepath.Clean(key) != "."
+}
+
+// New returns the backend selected by the configuration
+func New(cfg *config.Config) Backend {
+	if cfg.S3 {
+		return NewS3(cfg.S3Client, cfg.S3Bucket, cfg.StoragePath, S3UploadOptions{
+			PartSize:    cfg.S3PartSize,
+			Concurrency: cfg.S3UploadConcurrency,
+		})
+	}
+	return NewFS(cfg.StoragePath)
+}
+
+// PutFile stores the local file at path under key, moving it when the backend
+// supports it and copying it otherwise. The file is removed on success.
+func PutFile(ctx context.Context, b Backend, key, path string, opts PutOptions) (*ObjectInfo, error) {
+	if importer, ok := b.(Importer); ok {
+		return importer.Import(ctx, key, path, opts)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := b.Put(ctx, key, file, opts)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	return info, nil
+}
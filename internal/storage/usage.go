@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"path"
+
+	"goviesdeze/internal/utils"
+)
+
+// Usage returns the accounting record for a stored object
+func (o *ObjectInfo) Usage() utils.FileUsage {
+	return utils.FileUsage{
+		Name:        path.Base(o.Key),
+		Size:        o.Size,
+		ContentType: o.ContentType,
+		Owner:       o.Owner,
+	}
+}
+
+// RecordPut updates the usage for an object stored by Put or Import, crediting
+// the version it replaced
+func RecordPut(info *ObjectInfo) {
+	if info.Replaced != nil {
+		utils.ReplaceFile(info.Replaced.Usage(), info.Usage())
+		return
+	}
+	utils.AddFile(info.Usage())
+}
+
+// Scan walks every object in the backend and builds a fresh usage model. On
+// S3 this sends a HEAD request per object to recover owners and content types.
+func Scan(ctx context.Context, b Backend) (*utils.UsageData, error) {
+	usage := utils.NewUsageData()
+	err := b.List(ctx, ListOptions{Metadata: true}, func(info *ObjectInfo) error {
+		usage.Add(info.Usage())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
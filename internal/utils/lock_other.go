@@ -0,0 +1,13 @@
+//go:build !unix
+
+package utils
+
+import "errors"
+
+// ErrUsageLocked is returned when another process holds the usage file
+var ErrUsageLocked = errors.New("usage file is in use by another process")
+
+// LockUsage is a no-op where file locks are not supported
+func LockUsage(path string) (func(), error) {
+	return func() {}, nil
+}
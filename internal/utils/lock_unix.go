@@ -0,0 +1,30 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// ErrUsageLocked is returned when another process holds the usage file
+var ErrUsageLocked = errors.New("usage file is in use by another process")
+
+// LockUsage takes an exclusive lock next to the usage file at path so a
+// server and a rescan never write it at the same time. The lock is dropped
+// when the process exits.
+func LockUsage(path string) (func(), error) {
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrUsageLocked
+		}
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,375 @@
+package utils
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largestFilesTracked is how many of the biggest files the usage keeps
+const largestFilesTracked = 20
+
+// FileUsage identifies a stored file for usage accounting
+type FileUsage struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"sizeBytes"`
+	ContentType string `json:"contentType,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// UsageGroup holds the totals of one shard, prefix or content type
+type UsageGroup struct {
+	Size  int64 `json:"sizeBytes"`
+	Count int64 `json:"fileCount"`
+}
+
+// UsageData represents the structure of the usage file
+type UsageData struct {
+	TotalSize    int64                  `json:"totalSize"`
+	FileCount    int64                  `json:"fileCount"`
+	Shards       map[string]*UsageGroup `json:"shards"`
+	Prefixes     map[string]*UsageGroup `json:"prefixes"`
+	ContentTypes map[string]*UsageGroup `json:"contentTypes"`
+	Owners       map[string]*UsageGroup `json:"owners"`
+	// LargestFiles is ordered by size. Removing one of them shrinks the list
+	// until the next rescan, as smaller files are not tracked individually.
+	LargestFiles []FileUsage `json:"largestFiles"`
+}
+
+// NewUsageData returns an empty accounting model
+func NewUsageData() *UsageData {
+	return &UsageData{
+		Shards:       map[string]*UsageGroup{},
+		Prefixes:     map[string]*UsageGroup{},
+		ContentTypes: map[string]*UsageGroup{},
+		Owners:       map[string]*UsageGroup{},
+	}
+}
+
+// Add accounts for a new file
+func (u *UsageData) Add(file FileUsage) {
+	u.apply(file, 1)
+
+	// Replace a stale entry for the same name and keep the list sorted
+	u.removeLargest(file.Name)
+	i := sort.Search(len(u.LargestFiles), func(i int) bool { return u.LargestFiles[i].Size < file.Size })
+	if i < largestFilesTracked {
+		u.LargestFiles = append(u.LargestFiles, FileUsage{})
+		copy(u.LargestFiles[i+1:], u.LargestFiles[i:])
+		u.LargestFiles[i] = file
+		if len(u.LargestFiles) > largestFilesTracked {
+			u.LargestFiles = u.LargestFiles[:largestFilesTracked]
+		}
+	}
+}
+
+// Remove accounts for a deleted or replaced file
+func (u *UsageData) Remove(file FileUsage) {
+	u.apply(file, -1)
+	u.removeLargest(file.Name)
+}
+
+// apply adds sign times the file to the totals and every group
+func (u *UsageData) apply(file FileUsage, sign int64) {
+	u.TotalSize += sign * file.Size
+	u.FileCount += sign
+
+	if u.Shards == nil {
+		u.Shards = map[string]*UsageGroup{}
+	}
+	if u.Prefixes == nil {
+		u.Prefixes = map[string]*UsageGroup{}
+	}
+	if u.ContentTypes == nil {
+		u.ContentTypes = map[string]*UsageGroup{}
+	}
+	if u.Owners == nil {
+		u.Owners = map[string]*UsageGroup{}
+	}
+	applyGroup(u.Shards, usageShard(file.Name), file.Size, sign)
+	applyGroup(u.Prefixes, usagePrefix(file.Name), file.Size, sign)
+	applyGroup(u.ContentTypes, usageContentType(file.ContentType), file.Size, sign)
+	applyGroup(u.Owners, file.Owner, file.Size, sign)
+}
+
+// applyGroup adds sign times a file of size to one group, dropping groups
+// that become empty
+func applyGroup(groups map[string]*UsageGroup, name string, size, sign int64) {
+	group, ok := groups[name]
+	if !ok {
+		group = &UsageGroup{}
+		groups[name] = group
+	}
+	group.Size += sign * size
+	group.Count += sign
+	if group.Count <= 0 && group.Size <= 0 {
+		delete(groups, name)
+	}
+}
+
+func (u *UsageData) removeLargest(name string) {
+	for i, file := range u.LargestFiles {
+		if file.Name == name {
+			u.LargestFiles = append(u.LargestFiles[:i], u.LargestFiles[i+1:]...)
+			return
+		}
+	}
+}
+
+// prefixSeparators end the prefix of a filename, e.g. "cvpp_123.pdf" has
+// the prefix "cvpp"
+var prefixSeparators = "_-"
+
+// SetPrefixSeparators changes which characters end a filename prefix
+func SetPrefixSeparators(separators string) {
+	prefixSeparators = separators
+}
+
+// usageShard returns the shard directory of a filename as used by ShardPath
+func usageShard(name string) string {
+	if len(name) < 2 {
+		return ""
+	}
+	return name[:2]
+}
+
+// usagePrefix returns the part of a filename before the first separator, or
+// an empty string if it has none
+func usagePrefix(name string) string {
+	if i := strings.IndexAny(name, prefixSeparators); i > 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// usageContentType strips parameters from a content type
+func usageContentType(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return "unknown"
+	}
+	return mediaType
+}
+
+var (
+	usageMu sync.Mutex
+	usage   = NewUsageData()
+)
+
+// GetUsage returns the current total disk usage in bytes
+func GetUsage() int64 {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	return usage.TotalSize
+}
+
+// GetFileCount returns the current number of stored files
+func GetFileCount() int64 {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	return usage.FileCount
+}
+
+// GetOwnerUsage returns the bytes stored by one API key
+func GetOwnerUsage(owner string) int64 {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if group, ok := usage.Owners[owner]; ok {
+		return group.Size
+	}
+	return 0
+}
+
+// GetUsageData returns a copy of the full accounting model
+func GetUsageData() *UsageData {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	data, _ := json.Marshal(usage)
+	snapshot := NewUsageData()
+	json.Unmarshal(data, snapshot)
+	return snapshot
+}
+
+// AddFile accounts for a newly stored file
+func AddFile(file FileUsage) error {
+	usageMu.Lock()
+	usage.Add(file)
+	usageMu.Unlock()
+	return saveUsage()
+}
+
+// RemoveFile accounts for a deleted file
+func RemoveFile(file FileUsage) error {
+	usageMu.Lock()
+	usage.Remove(file)
+	usageMu.Unlock()
+	return saveUsage()
+}
+
+// ReplaceFile accounts for a file replacing an older version
+func ReplaceFile(old, file FileUsage) error {
+	usageMu.Lock()
+	usage.Remove(old)
+	usage.Add(file)
+	usageMu.Unlock()
+	return saveUsage()
+}
+
+// ReplaceUsage replaces the whole model, e.g. with the result of a rescan
+func ReplaceUsage(data *UsageData) error {
+	usageMu.Lock()
+	usage = data
+	usageMu.Unlock()
+	return saveUsage()
+}
+
+// legacyUsagePath is where usage.json was kept before it moved into the
+// storage directory
+const legacyUsagePath = "./usage.json"
+
+var usagePath = legacyUsagePath
+
+// LoadUsage loads disk usage from the usage file at path, which is also where
+// later changes are saved. A usage.json in the working directory left by older
+// versions is picked up when path does not exist yet.
+func LoadUsage(path string) error {
+	usagePath = path
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && path != legacyUsagePath {
+		data, err = os.ReadFile(legacyUsagePath)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			usageMu.Lock()
+			usage = NewUsageData()
+			usageMu.Unlock()
+			return nil
+		}
+		return err
+	}
+
+	usageData := NewUsageData()
+	if err := json.Unmarshal(data, usageData); err != nil {
+		return err
+	}
+
+	usageMu.Lock()
+	usage = usageData
+	usageMu.Unlock()
+	return nil
+}
+
+// usagePersister is the single goroutine writing the usage file. Changes are
+// coalesced so a burst of uploads results in one write per interval.
+type usagePersister struct {
+	delay   time.Duration
+	pending chan struct{}
+	flush   chan chan error
+}
+
+var persister *usagePersister
+
+// StartUsagePersister starts saving usage changes in the background, at most
+// once per delay. It must be called once, after LoadUsage.
+func StartUsagePersister(delay time.Duration) {
+	persister = &usagePersister{
+		delay:   delay,
+		pending: make(chan struct{}, 1),
+		flush:   make(chan chan error),
+	}
+	go persister.run()
+}
+
+// FlushUsage writes any pending usage change to disk and waits for it
+func FlushUsage() error {
+	if persister == nil {
+		return writeUsage()
+	}
+	done := make(chan error)
+	persister.flush <- done
+	return <-done
+}
+
+func (p *usagePersister) run() {
+	for {
+		select {
+		case <-p.pending:
+			timer := time.NewTimer(p.delay)
+			select {
+			case <-timer.C:
+				if err := writeUsage(); err != nil {
+					log.Printf("Failed to save usage: %v", err)
+				}
+			case done := <-p.flush:
+				timer.Stop()
+				done <- writeUsage()
+			}
+		case done := <-p.flush:
+			done <- writeUsage()
+		}
+	}
+}
+
+// saveUsage schedules the current totals to be saved. Without a running
+// persister, e.g. in command line tools, it writes immediately.
+func saveUsage() error {
+	if persister == nil {
+		return writeUsage()
+	}
+	select {
+	case persister.pending <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeUsage saves the current totals to the usage file. It writes and syncs
+// a temporary file and renames it into place, so a crash never leaves a
+// partially written file behind.
+func writeUsage() error {
+	usageMu.Lock()
+	data, err := json.Marshal(usage)
+	usageMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(usagePath)
+	tmpFile, err := os.CreateTemp(dir, ".usage_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), usagePath); err != nil {
+		return err
+	}
+
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -1,11 +1,8 @@
 package utils
 
 import (
-	"encoding/json"
-	"os"
 	"path/filepath"
 	"strings"
-	"sync/atomic"
 )
 
 // ShardPath creates a sharded path by using the first two characters of the filename as a subdirectory
@@ -17,6 +14,12 @@ func ShardPath(filename, storagePath string) string {
 	return filepath.Join(storagePath, shard, filename)
 }
 
+// ShardKey returns the storage key for a filename, which is its sharded path
+// relative to the storage root
+func ShardKey(filename string) string {
+	return filepath.ToSlash(ShardPath(filename, ""))
+}
+
 // GenerateCandidatePaths generates an array of candidate paths for file lookup
 func GenerateCandidatePaths(basePath string) []string {
 	candidates := []string{basePath}
@@ -39,57 +42,3 @@ func GenerateCandidatePaths(basePath string) []string {
 
 	return candidates
 }
-
-// UsageData represents the structure of the usage.json file
-type UsageData struct {
-	TotalSize int64 `json:"totalSize"`
-}
-
-var totalSize int64
-
-// GetUsage returns the current total disk usage in bytes
-func GetUsage() int64 {
-	return atomic.LoadInt64(&totalSize)
-}
-
-// SetUsage sets the total disk usage to a specific value
-func SetUsage(size int64) error {
-	atomic.SwapInt64(&totalSize, size)
-	return saveUsage()
-}
-
-// AddUsage adds a specific value to the total disk usage
-func AddUsage(size int64) error {
-	atomic.AddInt64(&totalSize, size)
-	return saveUsage()
-}
-
-// LoadUsage loads disk usage from the usage.json file
-func LoadUsage() error {
-	data, err := os.ReadFile("./usage.json")
-	if err != nil {
-		if os.IsNotExist(err) {
-			totalSize = 0
-			return nil
-		}
-		return err
-	}
-
-	var usageData UsageData
-	if err := json.Unmarshal(data, &usageData); err != nil {
-		return err
-	}
-
-	atomic.SwapInt64(&totalSize, usageData.TotalSize)
-	return nil
-}
-
-// saveUsage saves the current totalSize to the usage.json file
-func saveUsage() error {
-	usageData := UsageData{TotalSize: atomic.LoadInt64(&totalSize)}
-	data, err := json.Marshal(usageData)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile("./usage.json", data, 0644)
-}
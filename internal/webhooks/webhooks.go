@@ -0,0 +1,244 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// baseDelay is the wait before the first retry, doubled for every attempt
+	baseDelay = 5 * time.Second
+	// maxDelay caps the wait between attempts
+	maxDelay = time.Hour
+)
+
+// delivery is a callback waiting to be sent, persisted as one file so it
+// survives a restart
+type delivery struct {
+	ID          string          `json:"id"`
+	CallbackURL string          `json:"callbackUrl"`
+	Payload     json.RawMessage `json:"payload"`
+	// Pending is set while the payload is only the fallback sent if the
+	// service restarts before the real one is known
+	Pending     bool      `json:"pending,omitempty"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// Dispatcher POSTs signed JSON payloads to callback URLs, retrying failed
+// deliveries with exponential backoff
+type Dispatcher struct {
+	dir         string
+	secret      []byte
+	maxAttempts int
+	client      *http.Client
+
+	mu sync.Mutex
+}
+
+// NewDispatcher keeps deliveries in dir and resumes the ones left over from a
+// previous run. Callbacks are sent with client, which should refuse internal
+// addresses since callback URLs are chosen by callers.
+func NewDispatcher(dir string, secret []byte, maxAttempts int, client *http.Client) *Dispatcher {
+	d := &Dispatcher{
+		dir:         dir,
+		secret:      secret,
+		maxAttempts: maxAttempts,
+		client:      client,
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to create webhook directory: %v", err)
+	}
+	d.resume()
+	return d
+}
+
+// Register records a callback for id before its payload is known. If the
+// service restarts before Deliver is called, fallback is sent instead.
+func (d *Dispatcher) Register(id, callbackURL string, fallback any) error {
+	payload, err := json.Marshal(fallback)
+	if err != nil {
+		return err
+	}
+	return d.save(&delivery{
+		ID:          id,
+		CallbackURL: callbackURL,
+		Payload:     payload,
+		Pending:     true,
+	})
+}
+
+// Deliver sends payload to the callback registered for id
+func (d *Dispatcher) Deliver(id string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode webhook %s: %v", id, err)
+		return
+	}
+
+	dl, err := d.load(id)
+	if err != nil {
+		log.Printf("Failed to load webhook %s: %v", id, err)
+		return
+	}
+	dl.Payload = data
+	dl.Pending = false
+	dl.NextAttempt = time.Now()
+	if err := d.save(dl); err != nil {
+		log.Printf("Failed to save webhook %s: %v", id, err)
+	}
+	go d.run(dl)
+}
+
+// resume schedules every delivery found on disk
+func (d *Dispatcher) resume() {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		log.Printf("Failed to read webhook directory: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		dl, err := d.load(id)
+		if err != nil {
+			log.Printf("Failed to load webhook %s: %v", id, err)
+			continue
+		}
+		dl.Pending = false
+		go d.run(dl)
+	}
+}
+
+// run sends a delivery until it succeeds or runs out of attempts
+func (d *Dispatcher) run(dl *delivery) {
+	for {
+		time.Sleep(time.Until(dl.NextAttempt))
+
+		err := d.send(dl)
+		dl.Attempts++
+		if err == nil {
+			d.remove(dl.ID)
+			return
+		}
+
+		if dl.Attempts >= d.maxAttempts {
+			log.Printf("Giving up on webhook %s to %s after %d attempts: %v", dl.ID, dl.CallbackURL, dl.Attempts, err)
+			d.remove(dl.ID)
+			return
+		}
+
+		dl.LastError = err.Error()
+		dl.NextAttempt = time.Now().Add(backoff(dl.Attempts))
+		if err := d.save(dl); err != nil {
+			log.Printf("Failed to save webhook %s: %v", dl.ID, err)
+		}
+	}
+}
+
+// send POSTs the payload once. The signature covers the timestamp and the
+// body so receivers can reject replays.
+func (d *Dispatcher) send(dl *delivery) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(dl.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, dl.CallbackURL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", dl.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff returns the wait after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func (d *Dispatcher) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d *Dispatcher) load(id string) (*delivery, error) {
+	data, err := os.ReadFile(d.path(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var dl delivery
+	if err := json.Unmarshal(data, &dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// save writes a delivery atomically so a crash never leaves a torn file
+func (d *Dispatcher) save(dl *delivery) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tmpFile, err := os.CreateTemp(d.dir, ".tmp_*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), d.path(dl.ID))
+}
+
+func (d *Dispatcher) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	os.Remove(d.path(id))
+}
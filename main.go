@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"goviesdeze/internal/config"
 	"goviesdeze/internal/handlers"
 	"goviesdeze/internal/middleware"
+	"goviesdeze/internal/quota"
 	"goviesdeze/internal/utils"
 
 	"github.com/gin-gonic/gin"
@@ -16,31 +23,92 @@ func main() {
 	// Load configuration
 	cfg := config.Load()
 
-	// Initialize storage usage
-	if err := utils.LoadUsage(); err != nil {
-		log.Printf("Warning: Failed to load usage: %v", err)
-	}
-
 	// Create storage directory if it doesn't exist
 	if err := os.MkdirAll(cfg.StoragePath, 0755); err != nil {
 		log.Fatalf("Failed to create storage directory: %v", err)
 	}
 
+	utils.SetPrefixSeparators(cfg.UsagePrefixSeparators)
+
+	// Run a subcommand instead of the server when one is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rescan":
+			rescan(cfg)
+			return
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+	}
+
+	// Initialize storage usage. The lock keeps an offline rescan from running
+	// while the server owns the usage file.
+	unlock, err := utils.LockUsage(cfg.UsagePath)
+	if err != nil {
+		log.Fatalf("Failed to lock usage file: %v", err)
+	}
+	defer unlock()
+	if err := utils.LoadUsage(cfg.UsagePath); err != nil {
+		log.Printf("Warning: Failed to load usage: %v", err)
+	}
+	utils.StartUsagePersister(cfg.UsageSaveInterval)
+
+	quota.Configure(quota.Limits{
+		Global:      cfg.QuotaBytes,
+		Keys:        cfg.KeyQuotas,
+		SoftPercent: cfg.QuotaSoftPercent,
+	})
+
 	// Setup Gin router
 	router := gin.Default()
 
+	// Client addresses are taken from forwarding headers only when they were
+	// set by a trusted proxy, signed links can be bound to them
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Add middleware
 	router.Use(middleware.RequestLogger())
 	if cfg.RequireAPIKey {
-		router.Use(middleware.APIKeyAuth(cfg.APIKey))
+		keys, err := middleware.NewKeySet(cfg.APIKeys)
+		if err != nil {
+			log.Fatalf("Invalid API keys: %v", err)
+		}
+		router.Use(middleware.APIKeyAuth(keys))
 	}
 
 	// Register routes
-	handlers.RegisterRoutes(router, cfg)
+	stopJobs := handlers.RegisterRoutes(router, cfg)
 
 	// Start server
-	log.Printf("Server running on port %s", cfg.Port)
-	if err := router.Run(":" + cfg.Port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: router,
+	}
+	go func() {
+		log.Printf("Server running on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, let running requests finish, stop the
+	// download jobs and save usage
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	log.Printf("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Warning: Failed to shut down cleanly: %v", err)
+	}
+	if err := stopJobs(ctx); err != nil {
+		log.Printf("Warning: Failed to stop download jobs: %v", err)
+	}
+	if err := utils.FlushUsage(); err != nil {
+		log.Printf("Warning: Failed to save usage: %v", err)
 	}
 }
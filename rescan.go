@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"goviesdeze/internal/config"
+	"goviesdeze/internal/storage"
+	"goviesdeze/internal/utils"
+)
+
+// rescan recomputes the storage usage from the backend contents and replaces
+// the persisted totals. A running server would overwrite the result, so it
+// only runs offline.
+func rescan(cfg *config.Config) {
+	unlock, err := utils.LockUsage(cfg.UsagePath)
+	if errors.Is(err, utils.ErrUsageLocked) {
+		log.Fatalf("The server is running, use POST /admin/usage/rescan instead")
+	}
+	if err != nil {
+		log.Fatalf("Failed to lock usage file: %v", err)
+	}
+	defer unlock()
+
+	if err := utils.LoadUsage(cfg.UsagePath); err != nil {
+		log.Printf("Warning: Failed to load usage: %v", err)
+	}
+	log.Printf("Current usage: %d bytes in %d files", utils.GetUsage(), utils.GetFileCount())
+
+	usage, err := storage.Scan(context.Background(), storage.New(cfg))
+	if err != nil {
+		log.Fatalf("Failed to scan storage: %v", err)
+	}
+
+	if err := utils.ReplaceUsage(usage); err != nil {
+		log.Fatalf("Failed to save usage: %v", err)
+	}
+	log.Printf("Rescanned usage: %d bytes in %d files", usage.TotalSize, usage.FileCount)
+}